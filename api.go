@@ -0,0 +1,128 @@
+package mailinabox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	miab "github.com/luv2code/gomiabdns"
+)
+
+var (
+	// ErrAuthFailed is returned when the box rejects the admin credentials.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrTOTPRequired is returned when the account has MFA enabled and
+	// the box asks for a TOTP code.
+	ErrTOTPRequired = errors.New("TOTP code required")
+	// ErrTOTPInvalid is returned when the box rejects a TOTP code.
+	ErrTOTPInvalid = errors.New("TOTP code invalid")
+	// ErrNotMailInABox is returned when the server at APIURL answers with
+	// a web page, a 404, or a success that is not the JSON a Mail-In-A-Box
+	// DNS API returns, which usually means APIURL points at the wrong host.
+	ErrNotMailInABox = errors.New("server does not look like a Mail-In-A-Box DNS API")
+)
+
+// get fetches an endpoint of the DNS API of the box responsible for zone
+// that gomiabdns does not cover. The path is relative to the DNS API root,
+// the parent of the custom records endpoint in APIURL. Only successful
+// responses are returned, and the caller must close their body.
+func (p *Provider) get(ctx context.Context, zone, path string) (*http.Response, error) {
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	apiURL := client.ApiUrl.JoinPath("..", path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, authError(body)
+	}
+	// The box reports its own errors in plain text, such as 400 Invalid
+	// domain name. A web page, typically from another server or a proxy,
+	// or no API at all where it should be, most likely means APIURL is
+	// wrong.
+	if resp.StatusCode == http.StatusNotFound || isHTML(resp.Header.Get("Content-Type")) {
+		return nil, fmt.Errorf("%w: GET %s: %s: %s", ErrNotMailInABox, resp.Request.URL.Redacted(), resp.Status, truncate(body))
+	}
+	return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, truncate(body))
+}
+
+// isHTML reports whether a Content-Type header names a web page.
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// maxBodyInError is how much of a response body error messages quote.
+const maxBodyInError = 200
+
+// truncate shortens a response body to quote it in an error message.
+func truncate(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > maxBodyInError {
+		s = s[:maxBodyInError] + "..."
+	}
+	return s
+}
+
+// getJSON fetches an endpoint with get and decodes the JSON response into v.
+func (p *Provider) getJSON(ctx context.Context, zone, path string, v any) (err error) {
+	ctx, end := p.startSpan(ctx, "GET "+path, zone, miab.DNSRecord{})
+	defer func() { end(err) }()
+	resp, err := p.get(ctx, zone, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: GET %s: %v: %s", ErrNotMailInABox, resp.Request.URL.Redacted(), err, truncate(body))
+	}
+	return nil
+}
+
+// authError explains a rejected login. The box names the TOTP problem in
+// the response body when the account has MFA enabled; such errors match
+// both ErrAuthFailed and ErrTOTPRequired or ErrTOTPInvalid.
+func authError(body []byte) error {
+	reason := strings.ToLower(string(body))
+	switch {
+	case strings.Contains(reason, "missing-totp-token"):
+		return fmt.Errorf("%w: %w; TOTP codes are not supported, use an account without MFA", ErrAuthFailed, ErrTOTPRequired)
+	case strings.Contains(reason, "invalid-totp-token"):
+		return fmt.Errorf("%w: %w", ErrAuthFailed, ErrTOTPInvalid)
+	case strings.Contains(reason, "totp"):
+		return fmt.Errorf("%w: the account requires a TOTP code, which is not supported; use an account without MFA", ErrAuthFailed)
+	}
+	return fmt.Errorf("%w: check the email address and password", ErrAuthFailed)
+}
+
+// VerifyCredentials checks that the box accepts the configured admin
+// credentials, without changing anything on it. It returns ErrNotMailInABox
+// when APIURL does not lead to a Mail-In-A-Box DNS API.
+func (p *Provider) VerifyCredentials(ctx context.Context) error {
+	_, err := p.controlledZones(ctx, "")
+	return err
+}
@@ -0,0 +1,130 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCredentials(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	if err := p.VerifyCredentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.Password = "wrong"
+	if err := p.VerifyCredentials(context.Background()); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v, want ErrAuthFailed", err)
+	}
+
+	p.Password = mockPassword
+	box.totpError = "missing-totp-token"
+	err := p.VerifyCredentials(context.Background())
+	if !errors.Is(err, ErrAuthFailed) || !errors.Is(err, ErrTOTPRequired) {
+		t.Fatalf("got %v, want ErrAuthFailed and ErrTOTPRequired", err)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("VerifyCredentials made writes %q", w)
+	}
+}
+
+func TestNotMailInABox(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("Not here. ", 100) + "</body></html>"
+	tests := map[string]struct {
+		status      int
+		contentType string
+	}{
+		"error page": {http.StatusNotFound, "text/html; charset=utf-8"},
+		"web page":   {http.StatusOK, "text/html"},
+		"plain 404":  {http.StatusNotFound, "text/plain"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, page)
+			}))
+			defer server.Close()
+			p := &Provider{
+				APIURL:       server.URL + "/admin/dns/custom",
+				EmailAddress: mockEmail,
+				Password:     mockPassword,
+			}
+			err := p.VerifyCredentials(context.Background())
+			if !errors.Is(err, ErrNotMailInABox) {
+				t.Fatalf("got %v, want ErrNotMailInABox", err)
+			}
+			if len(err.Error()) > len(page) {
+				t.Fatalf("error quotes the whole page: %v", err)
+			}
+			if strings.Contains(err.Error(), mockPassword) {
+				t.Fatalf("error reveals the password: %v", err)
+			}
+		})
+	}
+}
+
+func TestPlainTextError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid domain name.", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	p := &Provider{
+		APIURL:       server.URL + "/admin/dns/custom",
+		EmailAddress: mockEmail,
+		Password:     mockPassword,
+	}
+	err := p.VerifyCredentials(context.Background())
+	if err == nil || errors.Is(err, ErrNotMailInABox) {
+		t.Fatalf("got %v, want an error that is not ErrNotMailInABox", err)
+	}
+	if !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "Invalid domain name.") {
+		t.Fatalf("got %v, want the status and body of the response", err)
+	}
+
+	box := newMockBox(t, "example.com")
+	_, err = box.provider().ExportZoneFile(context.Background(), "example.com")
+	if err == nil || errors.Is(err, ErrNotMailInABox) {
+		t.Fatalf("got %v for a zone without a zone file, want an error that is not ErrNotMailInABox", err)
+	}
+	if !strings.Contains(err.Error(), "no such zone") {
+		t.Fatalf("got %v, want the body of the response", err)
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	tests := []struct {
+		body string
+		want []error
+		not  []error
+	}{
+		{`{"status": "invalid", "reason": "Incorrect email address or password."}`, []error{ErrAuthFailed}, []error{ErrTOTPRequired, ErrTOTPInvalid}},
+		{"missing-totp-token\n", []error{ErrAuthFailed, ErrTOTPRequired}, []error{ErrTOTPInvalid}},
+		{`{"status": "error", "reason": "invalid-totp-token"}`, []error{ErrAuthFailed, ErrTOTPInvalid}, []error{ErrTOTPRequired}},
+	}
+	for _, tt := range tests {
+		err := authError([]byte(tt.body))
+		for _, target := range tt.want {
+			if !errors.Is(err, target) {
+				t.Errorf("%s: got %v, want %v", tt.body, err, target)
+			}
+		}
+		for _, target := range tt.not {
+			if errors.Is(err, target) {
+				t.Errorf("%s: got %v, which should not match %v", tt.body, err, target)
+			}
+		}
+	}
+
+	box := newMockBox(t, "example.com")
+	box.totpError = "invalid-totp-token"
+	_, err := box.provider().GetRecords(context.Background(), "example.com")
+	if !errors.Is(err, ErrAuthFailed) || !errors.Is(err, ErrTOTPInvalid) {
+		t.Fatalf("got %v, want ErrAuthFailed and ErrTOTPInvalid", err)
+	}
+}
@@ -0,0 +1,75 @@
+package mailinabox
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// The New functions build records validated like the provider validates
+// writes. The box does not store TTLs, so ttl is only kept on the record for
+// callers that pass it elsewhere as well; it must not be negative, and it
+// must be zero for records written by a Provider with StrictValidation,
+// which rejects TTLs.
+
+// NewA returns an A record for name pointing at the IPv4 address ip.
+func NewA(name, ip string, ttl time.Duration) (libdns.Record, error) {
+	return newRecord(miab.A, name, ip, 0, ttl)
+}
+
+// NewAAAA returns an AAAA record for name pointing at the IPv6 address ip.
+func NewAAAA(name, ip string, ttl time.Duration) (libdns.Record, error) {
+	return newRecord(miab.AAAA, name, ip, 0, ttl)
+}
+
+// NewCNAME returns a CNAME record making name an alias of target.
+func NewCNAME(name, target string, ttl time.Duration) (libdns.Record, error) {
+	return newRecord(miab.CNAME, name, target, 0, ttl)
+}
+
+// NewNS returns an NS record delegating name to the name server target.
+func NewNS(name, target string, ttl time.Duration) (libdns.Record, error) {
+	return newRecord(miab.NS, name, target, 0, ttl)
+}
+
+// NewTXT returns a TXT record for name holding text.
+func NewTXT(name, text string, ttl time.Duration) (libdns.Record, error) {
+	return newRecord(miab.TXT, name, text, 0, ttl)
+}
+
+// NewMX returns an MX record for name with the given preference and mail
+// server target.
+func NewMX(name string, pref uint16, target string, ttl time.Duration) (libdns.Record, error) {
+	value := strconv.Itoa(int(pref)) + " " + target
+	return newRecord(miab.MX, name, value, int(pref), ttl)
+}
+
+// NewSRV returns an SRV record for name, such as "_sip._tcp", pointing at
+// port on target.
+func NewSRV(name string, priority, weight, port uint16, target string, ttl time.Duration) (libdns.Record, error) {
+	value := fmt.Sprintf("%d %d %d %s", priority, weight, port, target)
+	return newRecord(miab.SRV, name, value, int(priority), ttl)
+}
+
+// NewCAA returns a CAA record for name with the given flags, property tag
+// (such as "issue") and value.
+func NewCAA(name string, flags uint8, tag, value string, ttl time.Duration) (libdns.Record, error) {
+	return newRecord(miab.CAA, name, fmt.Sprintf("%d %s %q", flags, tag, value), 0, ttl)
+}
+
+func newRecord(rtype miab.RecordType, name, value string, priority int, ttl time.Duration) (libdns.Record, error) {
+	r := libdns.Record{
+		Type:     string(rtype),
+		Name:     name,
+		Value:    value,
+		TTL:      ttl,
+		Priority: priority,
+	}
+	if err := checkRecord(name, r); err != nil {
+		return libdns.Record{}, err
+	}
+	return r, nil
+}
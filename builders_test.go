@@ -0,0 +1,82 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestBuilders(t *testing.T) {
+	build := func(r libdns.Record, err error) libdns.Record {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	records := []libdns.Record{
+		build(NewA("www", "192.0.2.1", 0)),
+		build(NewAAAA("www", "2001:db8::1", 0)),
+		build(NewCNAME("alias", "www.example.com.", 0)),
+		build(NewNS("sub", "ns1.example.net.", 0)),
+		build(NewTXT("@", "v=spf1 -all", 0)),
+		build(NewMX("@", 10, "mail.example.com.", 0)),
+		build(NewSRV("_sip._tcp", 10, 5, 5060, "sip.example.com.", 0)),
+		build(NewCAA("@", 0, "issue", "letsencrypt.org", 0)),
+	}
+	if r := records[5]; r.Value != "10 mail.example.com." || r.Priority != 10 {
+		t.Errorf("NewMX built %+v", r)
+	}
+	if r := records[6]; r.Value != "10 5 5060 sip.example.com." || r.Priority != 10 {
+		t.Errorf("NewSRV built %+v", r)
+	}
+	if r := records[7]; r.Value != `0 issue "letsencrypt.org"` {
+		t.Errorf("NewCAA built %+v", r)
+	}
+
+	// The records can be written as they are, in strict mode too.
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	p.StrictValidation = true
+	if _, err := p.AppendRecords(context.Background(), "example.com", records); err != nil {
+		t.Fatal(err)
+	}
+	if got := box.stored(); len(got) != len(records) {
+		t.Fatalf("stored %q, want %d records", got, len(records))
+	}
+
+	r := build(NewA("www", "192.0.2.1", time.Hour))
+	if r.TTL != time.Hour {
+		t.Errorf("NewA dropped the TTL: %+v", r)
+	}
+	if _, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{r}); err == nil {
+		t.Error("record with a TTL accepted in strict mode")
+	}
+}
+
+func TestBuildersValidate(t *testing.T) {
+	tests := map[string]func() (libdns.Record, error){
+		"A with an IPv6 address":    func() (libdns.Record, error) { return NewA("www", "2001:db8::1", 0) },
+		"AAAA with an IPv4 address": func() (libdns.Record, error) { return NewAAAA("www", "192.0.2.1", 0) },
+		"CNAME with a bad target":   func() (libdns.Record, error) { return NewCNAME("alias", "not a host", 0) },
+		"NS with no target":         func() (libdns.Record, error) { return NewNS("sub", "", 0) },
+		"empty TXT":                 func() (libdns.Record, error) { return NewTXT("@", "", 0) },
+		"MX with a bad target":      func() (libdns.Record, error) { return NewMX("@", 10, "mail..example.com", 0) },
+		"SRV with a bad target":     func() (libdns.Record, error) { return NewSRV("_sip._tcp", 10, 5, 5060, "-sip.example.com", 0) },
+		"CAA with a bad tag":        func() (libdns.Record, error) { return NewCAA("@", 0, "is-sue", "letsencrypt.org", 0) },
+		"negative TTL":              func() (libdns.Record, error) { return NewA("www", "192.0.2.1", -time.Second) },
+	}
+	for name, build := range tests {
+		r, err := build()
+		var invalid *InvalidRecordError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s: got %v, want an InvalidRecordError", name, err)
+		}
+		if r != (libdns.Record{}) {
+			t.Errorf("%s: got record %+v along with the error", name, r)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package mailinabox
+
+import "encoding/json"
+
+// UnmarshalJSON reads a Provider from the keys of its struct tags, and
+// also accepts the key names other config loaders commonly use: "url" for
+// api_url, "email" or "username" for email_address, "api_key" for password
+// and "zone" for default_zone. The documented keys win when both are set.
+func (p *Provider) UnmarshalJSON(data []byte) error {
+	// plain has the fields of Provider but not this method, so decoding
+	// into it does not recurse.
+	type plain Provider
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	var aliases struct {
+		URL      string `json:"url"`
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		APIKey   string `json:"api_key"`
+		Zone     string `json:"zone"`
+	}
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return err
+	}
+	setDefault(&p.APIURL, aliases.URL)
+	setDefault(&p.EmailAddress, aliases.Email)
+	setDefault(&p.EmailAddress, aliases.Username)
+	setDefault(&p.Password, aliases.APIKey)
+	setDefault(&p.DefaultZone, aliases.Zone)
+	return nil
+}
+
+// setDefault sets *field to value if it is still empty.
+func setDefault(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
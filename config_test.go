@@ -0,0 +1,37 @@
+package mailinabox
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnmarshalJSONAliases(t *testing.T) {
+	tests := []struct {
+		json string
+		want Provider
+	}{
+		{
+			`{"url": "https://box.example.com/admin/dns/custom", "email": "admin@example.com", "api_key": "secret", "zone": "example.com"}`,
+			Provider{APIURL: "https://box.example.com/admin/dns/custom", EmailAddress: "admin@example.com", Password: "secret", DefaultZone: "example.com"},
+		},
+		{
+			`{"username": "admin@example.com"}`,
+			Provider{EmailAddress: "admin@example.com"},
+		},
+		{
+			`{"api_url": "https://a.example.com", "url": "https://b.example.com", "email_address": "a@example.com", "email": "b@example.com", "password": "a", "api_key": "b", "default_zone": "a.example", "zone": "b.example"}`,
+			Provider{APIURL: "https://a.example.com", EmailAddress: "a@example.com", Password: "a", DefaultZone: "a.example"},
+		},
+	}
+	for _, tt := range tests {
+		var p Provider
+		if err := json.Unmarshal([]byte(tt.json), &p); err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if p.APIURL != tt.want.APIURL || p.EmailAddress != tt.want.EmailAddress || p.Password != tt.want.Password || p.DefaultZone != tt.want.DefaultZone {
+			t.Errorf("%s: got %q %q %q %q, want %q %q %q %q", tt.json,
+				p.APIURL, p.EmailAddress, p.Password, p.DefaultZone,
+				tt.want.APIURL, tt.want.EmailAddress, tt.want.Password, tt.want.DefaultZone)
+		}
+	}
+}
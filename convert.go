@@ -0,0 +1,57 @@
+package mailinabox
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// converter converts the records of one type between the box and libdns.
+type converter struct {
+	toLibDNS func(mr miab.DNSRecord, zone string) (libdns.Record, error)
+	toMIAB   func(r libdns.Record, zone string) (string, error)
+}
+
+var (
+	convertersMu sync.RWMutex
+	converters   = make(map[miab.RecordType]converter)
+)
+
+// RegisterConverter makes the provider convert records of recordType with
+// the given functions instead of its built-in conversion, and accept the
+// type for writing. It allows record types the box starts to support to be
+// used before this package knows about them. toLibDNS builds the record
+// from what the box lists, with the name relative to zone; toMIAB returns
+// the value to write to the box. Registering a type again replaces its
+// converter. RegisterConverter is usually called from an init function.
+func RegisterConverter(recordType string, toLibDNS func(mr miab.DNSRecord, zone string) (libdns.Record, error), toMIAB func(r libdns.Record, zone string) (string, error)) {
+	convertersMu.Lock()
+	defer convertersMu.Unlock()
+	converters[miab.RecordType(strings.ToUpper(recordType))] = converter{toLibDNS: toLibDNS, toMIAB: toMIAB}
+}
+
+// lookupConverter returns the converter registered for rtype, if any.
+func lookupConverter(rtype miab.RecordType) (converter, bool) {
+	convertersMu.RLock()
+	defer convertersMu.RUnlock()
+	c, ok := converters[miab.RecordType(strings.ToUpper(string(rtype)))]
+	return c, ok
+}
+
+// registeredTypes returns the record types with a registered converter
+// that are not supported already, sorted.
+func registeredTypes() []string {
+	convertersMu.RLock()
+	defer convertersMu.RUnlock()
+	var types []string
+	for t := range converters {
+		if !builtinType(t) {
+			types = append(types, string(t))
+		}
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,60 @@
+package mailinabox
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+func TestRegisterConverter(t *testing.T) {
+	// URI records keep their priority in Priority, as for MX and SRV.
+	RegisterConverter("uri",
+		func(mr miab.DNSRecord, zone string) (libdns.Record, error) {
+			priority, rest, _ := strings.Cut(mr.Value, " ")
+			n, err := strconv.Atoi(priority)
+			if err != nil {
+				return libdns.Record{}, err
+			}
+			return libdns.Record{
+				Type:     string(mr.RecordType),
+				Name:     libdns.RelativeName(mr.QualifiedName, zone),
+				Value:    rest,
+				Priority: n,
+			}, nil
+		},
+		func(r libdns.Record, zone string) (string, error) {
+			return fmt.Sprintf("%d %s", r.Priority, r.Value), nil
+		},
+	)
+	t.Cleanup(func() {
+		convertersMu.Lock()
+		delete(converters, "URI")
+		convertersMu.Unlock()
+	})
+	if !slices.Contains(SupportedRecordTypes(), "URI") {
+		t.Fatalf("URI missing from %q", SupportedRecordTypes())
+	}
+
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	record := libdns.Record{Type: "URI", Name: "_http._tcp", Value: `1 "https://www.example.com/"`, Priority: 10}
+	if _, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{record}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := box.stored(), []string{`_http._tcp.example.com URI 10 1 "https://www.example.com/"`}; !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+	records, err := p.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != record {
+		t.Fatalf("got %+v, want %+v", records, record)
+	}
+}
@@ -0,0 +1,270 @@
+package mailinabox
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	mockEmail    = "admin@example.com"
+	mockPassword = "secret"
+)
+
+// mockRecord is a custom record as the box stores it.
+type mockRecord struct {
+	QName string `json:"qname"`
+	RType string `json:"rtype"`
+	Value string `json:"value"`
+	Zone  string `json:"zone"`
+}
+
+// mockBox is an in-memory Mail-In-A-Box serving the DNS API endpoints the
+// provider uses: /admin/dns/custom[/<qname>[/<rtype>]], /admin/dns/zones,
+// /admin/dns/zonefile/<zone> and /admin/dns/secondary-nameserver.
+type mockBox struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu          sync.Mutex
+	accounts    map[string]string
+	totpError   string
+	normalize   func(rtype, value string) string
+	reject      func(method, qname, rtype, value string) bool
+	logins      []string
+	zones       []string
+	records     []mockRecord
+	calls       []string
+	zoneFiles   map[string]string
+	secondaries []string
+	inFlight    int
+	maxInFlight int
+}
+
+// newMockBox starts a box hosting zones, which is shut down when the test
+// ends.
+func newMockBox(t *testing.T, zones ...string) *mockBox {
+	m := &mockBox{
+		t:         t,
+		accounts:  map[string]string{mockEmail: mockPassword},
+		zones:     zones,
+		zoneFiles: make(map[string]string),
+	}
+	m.server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// provider returns a Provider pointed at the box.
+func (m *mockBox) provider() *Provider {
+	return &Provider{
+		APIURL:       m.server.URL + "/admin/dns/custom",
+		EmailAddress: mockEmail,
+		Password:     mockPassword,
+	}
+}
+
+// add stores records given as "qname rtype value" without recording a call.
+func (m *mockBox) add(records ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range records {
+		f := strings.SplitN(r, " ", 3)
+		m.records = append(m.records, mockRecord{QName: f[0], RType: f[1], Value: f[2], Zone: m.zoneOf(f[0])})
+	}
+}
+
+// stored returns the stored records as sorted "qname rtype value" strings.
+func (m *mockBox) stored() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, r := range m.records {
+		out = append(out, r.QName+" "+r.RType+" "+r.Value)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// writes returns the write calls made so far as "METHOD qname/rtype value".
+func (m *mockBox) writes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, c := range m.calls {
+		if !strings.HasPrefix(c, http.MethodGet) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// count returns how many calls were made with method to the custom
+// records endpoint.
+func (m *mockBox) count(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, c := range m.calls {
+		if strings.HasPrefix(c, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// resetCalls forgets the calls made so far.
+func (m *mockBox) resetCalls() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = nil
+}
+
+// setPassword changes the password of an admin account, creating it if
+// needed.
+func (m *mockBox) setPassword(email, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[email] = password
+}
+
+// loggedIn returns the accounts of the requests accepted so far, in order.
+func (m *mockBox) loggedIn() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.logins)
+}
+
+// zoneOf returns the hosted zone qname belongs to. m.mu must be held.
+func (m *mockBox) zoneOf(qname string) string {
+	match := ""
+	for _, z := range m.zones {
+		if (qname == z || strings.HasSuffix(qname, "."+z)) && len(z) > len(match) {
+			match = z
+		}
+	}
+	return match
+}
+
+func (m *mockBox) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.inFlight--
+		m.mu.Unlock()
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email, password, ok := r.BasicAuth()
+	if want, known := m.accounts[email]; !ok || !known || password != want {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"status": "invalid", "reason": "Incorrect email address or password."}`)
+		return
+	}
+	if m.totpError != "" {
+		// Accounts with MFA enabled fail like this, the box answering
+		// in plain text to clients that do not ask for JSON.
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, m.totpError+"\n")
+		return
+	}
+	m.logins = append(m.logins, email)
+	path := strings.TrimPrefix(r.URL.Path, "/admin/dns/")
+	switch {
+	case path == "zones":
+		json.NewEncoder(w).Encode(m.zones)
+	case path == "secondary-nameserver":
+		json.NewEncoder(w).Encode(map[string][]string{"hostnames": m.secondaries})
+	case strings.HasPrefix(path, "zonefile/"):
+		zoneFile, ok := m.zoneFiles[strings.TrimPrefix(path, "zonefile/")]
+		if !ok {
+			http.Error(w, "no such zone", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, zoneFile)
+	case path == "custom" || strings.HasPrefix(path, "custom/"):
+		m.serveCustom(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "custom"), "/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveCustom handles the custom records endpoint like the box does.
+// m.mu is held.
+func (m *mockBox) serveCustom(w http.ResponseWriter, r *http.Request, path string) {
+	var qname, rtype string
+	if path != "" {
+		parts := strings.SplitN(path, "/", 2)
+		qname, rtype = parts[0], "A"
+		if len(parts) == 2 {
+			rtype = parts[1]
+		}
+	}
+	body, _ := io.ReadAll(r.Body)
+	value := strings.TrimSpace(string(body))
+	m.calls = append(m.calls, strings.TrimSpace(r.Method+" "+path+" "+value))
+	if m.reject != nil && m.reject(r.Method, qname, rtype, value) {
+		// The box answers invalid writes in plain text, which
+		// gomiabdns does not treat as an error.
+		http.Error(w, "Invalid value.", http.StatusBadRequest)
+		return
+	}
+	if m.normalize != nil && r.Method != http.MethodGet && value != "" {
+		value = m.normalize(rtype, value)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		out := []mockRecord{}
+		for _, rec := range m.records {
+			if qname == "" || (rec.QName == qname && rec.RType == rtype) {
+				out = append(out, rec)
+			}
+		}
+		json.NewEncoder(w).Encode(out)
+	case http.MethodPost:
+		for _, rec := range m.records {
+			if rec.QName == qname && rec.RType == rtype && rec.Value == value {
+				io.WriteString(w, "OK")
+				return
+			}
+		}
+		m.records = append(m.records, mockRecord{QName: qname, RType: rtype, Value: value, Zone: m.zoneOf(qname)})
+		io.WriteString(w, "updated DNS: "+qname)
+	case http.MethodPut:
+		m.remove(qname, rtype, "")
+		m.records = append(m.records, mockRecord{QName: qname, RType: rtype, Value: value, Zone: m.zoneOf(qname)})
+		io.WriteString(w, "updated DNS: "+qname)
+	case http.MethodDelete:
+		m.remove(qname, rtype, value)
+		io.WriteString(w, "updated DNS: "+qname)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// remove deletes the records of qname and rtype with value, or all of them
+// when value is empty. m.mu is held.
+func (m *mockBox) remove(qname, rtype, value string) {
+	kept := m.records[:0]
+	for _, rec := range m.records {
+		if rec.QName == qname && rec.RType == rtype && (value == "" || rec.Value == value) {
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	m.records = kept
+}
@@ -0,0 +1,221 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// SwapRecord replaces oldValue with newValue for the record of the given
+// name and type. The new value is added before the old one is removed, so
+// the name never goes without a record; if adding fails, the old value is
+// left in place. Since gomiabdns does not report writes the box rejects,
+// the new value is read back before the old one is removed. A CNAME is
+// replaced in a single update instead, since a name cannot hold two of them.
+func (p *Provider) SwapRecord(ctx context.Context, zone, name, recordType, oldValue, newValue string) error {
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return err
+	}
+	oldRecord := libdns.Record{Type: recordType, Name: name, Value: oldValue}
+	newRecord, err := p.prepareRecord(zone, libdns.Record{Type: recordType, Name: name, Value: newValue})
+	if err != nil {
+		return err
+	}
+	if normalizeValue(newRecord.RecordType, oldValue) == newRecord.Value {
+		return nil
+	}
+	if newRecord.RecordType == miab.CNAME {
+		return p.updateHost(ctx, client, zone, newRecord)
+	}
+	if err := p.addHost(ctx, client, zone, newRecord); err != nil {
+		return err
+	}
+	stored, err := p.storedValues(ctx, client, zone, newRecord.QualifiedName, newRecord.RecordType)
+	if err != nil {
+		return err
+	}
+	if _, ok := stored[newRecord.Value]; !ok {
+		return writeError("adding", newRecord, errors.New("the box did not store the new value, so the old one was kept"))
+	}
+	_, err = p.deleteRecords(ctx, client, zone, []libdns.Record{oldRecord})
+	return err
+}
+
+// SetSimple sets one record of recordType for each entry of records, which
+// maps relative names to values, for example three A records from a map of
+// host names to addresses. Every value is validated before anything is
+// written. The box does not store TTLs, so ttl is not applied: it is set on
+// the records like any TTL passed to SetRecords, which means it must not
+// be negative, and must be zero under StrictValidation.
+func (p *Provider) SetSimple(ctx context.Context, zone string, records map[string]string, recordType string, ttl time.Duration) error {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	recs := make([]libdns.Record, 0, len(names))
+	for _, name := range names {
+		r := libdns.Record{Type: recordType, Name: name, Value: records[name], TTL: ttl}
+		if err := checkRecord(name, r); err != nil {
+			return err
+		}
+		recs = append(recs, r)
+	}
+	_, err := p.SetRecords(ctx, zone, recs)
+	return err
+}
+
+// PromoteStaged replaces the records at real names with those staged under
+// stagingPrefix, then deletes the staged copies. A record named
+// "www.staging" is promoted to "www", and one named "staging" to the zone
+// apex. Each promoted name and type takes exactly the staged values, set
+// the way SetRecords sets them. The box has no rename, so the real records
+// are written before the staged ones are removed, all under one zone lock.
+func (p *Provider) PromoteStaged(ctx context.Context, zone, stagingPrefix string) error {
+	stagingPrefix = strings.Trim(stagingPrefix, ".")
+	if stagingPrefix == "" {
+		return errors.New("staging prefix must not be empty")
+	}
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return err
+	}
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+	if err != nil {
+		return err
+	}
+	records, err := p.toLibDnsRecords(zone, miabRecords)
+	if err != nil {
+		return err
+	}
+	var staged, promoted []libdns.Record
+	for _, r := range records {
+		var name string
+		switch {
+		case r.Name == stagingPrefix:
+			name = ""
+		case strings.HasSuffix(r.Name, "."+stagingPrefix):
+			name = strings.TrimSuffix(r.Name, "."+stagingPrefix)
+		default:
+			continue
+		}
+		staged = append(staged, r)
+		r.ID = ""
+		r.Name = name
+		promoted = append(promoted, r)
+	}
+	if len(staged) == 0 {
+		return nil
+	}
+	sets, err := p.prepareRRSets(zone, promoted)
+	if err != nil {
+		return err
+	}
+	if _, err := p.setRRSets(ctx, client, zone, rrSetsOf(miabRecords), sets); err != nil {
+		return err
+	}
+	_, err = p.deleteRecords(ctx, client, zone, staged)
+	return err
+}
+
+// DeleteAllRecords deletes every custom record in the zone and returns how
+// many were deleted. It does nothing unless confirm is true. The apex NS
+// and SOA records are left in place unless AllowApexDeletion is set.
+func (p *Provider) DeleteAllRecords(ctx context.Context, zone string, confirm bool) (int, error) {
+	if !confirm {
+		return 0, errors.New("refusing to delete all records without confirmation")
+	}
+	zone = p.zoneOrDefault(zone)
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return 0, err
+	}
+	var doomed []libdns.Record
+	for _, r := range records {
+		name, err := qualifiedName(r.Name, zone)
+		if err != nil {
+			return 0, err
+		}
+		if !p.protected(name, zone, miab.RecordType(strings.ToUpper(r.Type))) {
+			doomed = append(doomed, r)
+		}
+	}
+	if len(doomed) == 0 {
+		return 0, nil
+	}
+	deleted, err := p.DeleteRecords(ctx, zone, doomed)
+	return len(deleted), err
+}
+
+// CreateIfAbsent adds the records whose name, type and value are not in the
+// zone yet, and returns the ones it created. Records already present are
+// left alone.
+func (p *Provider) CreateIfAbsent(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	if err := p.checkBatchSize(records); err != nil {
+		return nil, err
+	}
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	current, err := p.storedRRSets(ctx, client, zone)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[[3]string]bool)
+	var missing []libdns.Record
+	for _, r := range records {
+		mr, err := p.prepareRecord(zone, r)
+		if err != nil {
+			return nil, err
+		}
+		key := [2]string{mr.QualifiedName, string(mr.RecordType)}
+		if _, ok := current[key][mr.Value]; ok {
+			continue
+		}
+		if k := [3]string{key[0], key[1], mr.Value}; !seen[k] {
+			seen[k] = true
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) == 0 {
+		return []libdns.Record{}, nil
+	}
+	return p.appendRecords(ctx, client, zone, controlled, current, missing)
+}
@@ -0,0 +1,161 @@
+package mailinabox
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestPromoteStaged(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"www.example.com A 192.0.2.2",
+		"www.staging.example.com A 192.0.2.3",
+		"staging.example.com TXT apex",
+		"alias.example.com CNAME old.example.com.",
+		"alias.staging.example.com CNAME new.example.com.",
+		"other.example.com A 192.0.2.9",
+	)
+	if err := box.provider().PromoteStaged(context.Background(), "example.com", "staging"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"alias.example.com CNAME new.example.com.",
+		"example.com TXT apex",
+		"other.example.com A 192.0.2.9",
+		"www.example.com A 192.0.2.3",
+	}
+	if got := box.stored(); !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+}
+
+func TestSwapRecord(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1", "www.example.com A 192.0.2.2")
+	err := box.provider().SwapRecord(context.Background(), "example.com", "www", "A", "192.0.2.1", "192.0.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST www.example.com/A 192.0.2.3",
+		"DELETE www.example.com/A 192.0.2.1",
+	}
+	if got := box.writes(); !slices.Equal(got, want) {
+		t.Fatalf("writes %q, want %q", got, want)
+	}
+}
+
+func TestSwapRecordAddFailure(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("_acme-challenge.example.com TXT old-token")
+	box.reject = func(method, qname, rtype, value string) bool {
+		return method == http.MethodPost
+	}
+	err := box.provider().SwapRecord(context.Background(), "example.com", "_acme-challenge", "TXT", "old-token", "new-token")
+	if err == nil {
+		t.Fatal("SwapRecord succeeded although the box rejected the new value")
+	}
+	if got, want := box.stored(), []string{"_acme-challenge.example.com TXT old-token"}; !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want the old value kept", got)
+	}
+	if n := box.count(http.MethodDelete); n != 0 {
+		t.Fatalf("made %d deletes after the add failed", n)
+	}
+}
+
+func TestCreateIfAbsent(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	created, err := box.provider().CreateIfAbsent(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0].Value != "192.0.2.2" {
+		t.Fatalf("created %v, want only the new value", created)
+	}
+	if got, want := box.writes(), []string{"POST www.example.com/A 192.0.2.2"}; !slices.Equal(got, want) {
+		t.Fatalf("writes %q, want %q", got, want)
+	}
+}
+
+func TestSetSimple(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.9", "old.example.com A 192.0.2.8")
+	p := box.provider()
+	err := p.SetSimple(context.Background(), "example.com", map[string]string{
+		"www":  "192.0.2.1",
+		"mail": "192.0.2.2",
+		"@":    "192.0.2.3",
+	}, "A", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"example.com A 192.0.2.3",
+		"mail.example.com A 192.0.2.2",
+		"old.example.com A 192.0.2.8",
+		"www.example.com A 192.0.2.1",
+	}
+	if got := box.stored(); !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+
+	box.resetCalls()
+	err = p.SetSimple(context.Background(), "example.com", map[string]string{
+		"a": "192.0.2.1",
+		"b": "not-an-address",
+	}, "A", 0)
+	if err == nil {
+		t.Fatal("invalid value accepted")
+	}
+	if err := p.SetSimple(context.Background(), "example.com", map[string]string{"a": "192.0.2.1"}, "A", -time.Second); err == nil {
+		t.Fatal("negative TTL accepted")
+	}
+	p.StrictValidation = true
+	if err := p.SetSimple(context.Background(), "example.com", map[string]string{"a": "192.0.2.1"}, "A", time.Hour); err == nil {
+		t.Fatal("TTL accepted under StrictValidation")
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q", w)
+	}
+}
+
+func TestDeleteAllRecords(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"example.com NS ns1.example.com.",
+		"example.com MX 10 mail.example.com.",
+		"www.example.com A 192.0.2.1",
+		"www.example.com A 192.0.2.2",
+		"ns.example.com NS ns1.example.net.",
+	)
+	p := box.provider()
+	n, err := p.DeleteAllRecords(context.Background(), "example.com", false)
+	if err == nil || n != 0 {
+		t.Fatalf("got %d, %v without confirm, want an error", n, err)
+	}
+	if get := box.count(http.MethodGet); get != 0 || len(box.writes()) != 0 {
+		t.Fatalf("made %d reads and writes %q without confirm", get, box.writes())
+	}
+
+	n, err = p.DeleteAllRecords(context.Background(), "example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("deleted %d records, want 4", n)
+	}
+	if got, want := box.stored(), []string{"example.com NS ns1.example.com."}; !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want only the apex NS kept", got)
+	}
+}
@@ -0,0 +1,201 @@
+package mailinabox
+
+import (
+	"context"
+	"strings"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// ChangePlan lists the changes needed to bring a zone to a desired state.
+// It is produced by Plan and carried out by Apply.
+type ChangePlan struct {
+	Zone string
+	// Adds are records to create.
+	Adds []libdns.Record
+	// Updates replace the single value of a name and type.
+	Updates []libdns.Record
+	// Deletes are records to remove.
+	Deletes []libdns.Record
+}
+
+// Empty reports whether the plan has no changes.
+func (c ChangePlan) Empty() bool {
+	return len(c.Adds) == 0 && len(c.Updates) == 0 && len(c.Deletes) == 0
+}
+
+// Plan compares the records in the zone with desired and returns the changes
+// that would make the zone match it, without applying them. Records in the
+// zone that are not desired are planned for deletion. Records are compared
+// with EqualFunc, or EqualValues when it is not set.
+func (p *Provider) Plan(ctx context.Context, zone string, desired []libdns.Record) (ChangePlan, error) {
+	zone = p.zoneOrDefault(zone)
+	plan := ChangePlan{Zone: zone}
+	if _, err := p.zoneCheck(ctx, zone); err != nil {
+		return plan, err
+	}
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return plan, err
+	}
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+	if err != nil {
+		return plan, err
+	}
+
+	var keys [][2]string
+	want := make(map[[2]string][]libdns.Record)
+	have := make(map[[2]string][]miab.DNSRecord)
+	for _, r := range desired {
+		mr, err := p.prepareRecord(zone, r)
+		if err != nil {
+			return plan, err
+		}
+		key := [2]string{mr.QualifiedName, string(mr.RecordType)}
+		if want[key] == nil && have[key] == nil {
+			keys = append(keys, key)
+		}
+		r.Value = mr.Value
+		want[key] = append(want[key], r)
+	}
+	for _, mr := range miabRecords {
+		if !inZone(mr.QualifiedName, zone) {
+			continue
+		}
+		key := [2]string{mr.QualifiedName, string(mr.RecordType)}
+		if want[key] == nil && have[key] == nil {
+			keys = append(keys, key)
+		}
+		have[key] = append(have[key], mr)
+	}
+
+	for _, key := range keys {
+		w := want[key]
+		for i := range w {
+			w[i].Name = relativeName(key[0], zone)
+			w[i].Type = key[1]
+		}
+		var h []libdns.Record
+		for _, mr := range have[key] {
+			if r, err := toLibDnsRecord(zone, mr); err == nil {
+				h = append(h, r)
+			}
+		}
+		if len(w) == 1 && len(h) == 1 {
+			if !p.equal(w[0], h[0]) {
+				plan.Updates = append(plan.Updates, w[0])
+			}
+			continue
+		}
+		for _, r := range w {
+			if !p.containsRecord(h, r) {
+				plan.Adds = append(plan.Adds, r)
+			}
+		}
+		for _, r := range h {
+			if !p.containsRecord(w, r) {
+				plan.Deletes = append(plan.Deletes, r)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// EqualValues reports whether a and b have the same name, type and value.
+// It is the default equality of Plan. TTLs are ignored, as the box does not
+// store them.
+func EqualValues(a, b libdns.Record) bool {
+	return a.Name == b.Name && strings.EqualFold(a.Type, b.Type) && a.Value == b.Value
+}
+
+// EqualWithTTL is like EqualValues but also requires the TTLs to match.
+// Since records read from the box have no TTL, desired records with a TTL
+// are then always planned as changes.
+func EqualWithTTL(a, b libdns.Record) bool {
+	return EqualValues(a, b) && a.TTL == b.TTL
+}
+
+// equal compares a desired record with a stored one, using EqualFunc if set.
+func (p *Provider) equal(a, b libdns.Record) bool {
+	if p.EqualFunc != nil {
+		return p.EqualFunc(a, b)
+	}
+	return EqualValues(a, b)
+}
+
+// containsRecord reports whether records holds a record equal to r.
+func (p *Provider) containsRecord(records []libdns.Record, r libdns.Record) bool {
+	for _, other := range records {
+		if p.equal(r, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply carries out a plan returned by Plan: updates first, then additions,
+// then deletions. Progress, when set, is called as records are applied.
+func (p *Provider) Apply(ctx context.Context, plan ChangePlan) error {
+	if err := p.checkBatchSize(plan.Adds, plan.Updates, plan.Deletes); err != nil {
+		return err
+	}
+	zone := p.zoneOrDefault(plan.Zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return err
+	}
+	done, total := 0, len(plan.Updates)+len(plan.Adds)+len(plan.Deletes)
+	report := func(n int) {
+		done += n
+		if p.Progress != nil {
+			p.Progress(done, total)
+		}
+	}
+	// Validate the whole plan before writing anything.
+	updates, err := p.prepareRecords(zone, plan.Updates)
+	if err != nil {
+		return err
+	}
+	adds, err := p.prepareRecords(zone, plan.Adds)
+	if err != nil {
+		return err
+	}
+	if err := p.checkDeletes(zone, plan.Deletes); err != nil {
+		return err
+	}
+	for _, mr := range updates {
+		if err := p.checkBudget(ctx); err != nil {
+			return err
+		}
+		if err := p.updateHost(ctx, client, zone, mr); err != nil {
+			return err
+		}
+		report(1)
+	}
+	for _, mr := range adds {
+		if err := p.checkBudget(ctx); err != nil {
+			return err
+		}
+		if err := p.addHost(ctx, client, zone, mr); err != nil {
+			return err
+		}
+		report(1)
+	}
+	for _, group := range groupByNameAndType(plan.Deletes) {
+		if _, err := p.deleteRecords(ctx, client, zone, group); err != nil {
+			return err
+		}
+		report(len(group))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package mailinabox
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"old.example.com A 192.0.2.9",
+		"same.example.com TXT kept",
+	)
+	p := box.provider()
+	var progress [][2]int
+	p.Progress = func(done, total int) { progress = append(progress, [2]int{done, total}) }
+
+	plan, err := p.Plan(context.Background(), "example.com.", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+		{Type: "TXT", Name: "new", Value: "hello"},
+		{Type: "TXT", Name: "same", Value: "kept"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Updates) != 1 || plan.Updates[0].Name != "www" {
+		t.Errorf("updates %v, want www", plan.Updates)
+	}
+	if len(plan.Adds) != 1 || plan.Adds[0].Name != "new" {
+		t.Errorf("adds %v, want new", plan.Adds)
+	}
+	if len(plan.Deletes) != 1 || plan.Deletes[0].Name != "old" {
+		t.Errorf("deletes %v, want old", plan.Deletes)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("Plan made writes %q", w)
+	}
+
+	if err := p.Apply(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"PUT www.example.com/A 192.0.2.2",
+		"POST new.example.com/TXT hello",
+		"DELETE old.example.com/A 192.0.2.9",
+	}
+	if got := box.writes(); !slices.Equal(got, want) {
+		t.Fatalf("writes %q, want %q", got, want)
+	}
+	if wantProgress := [][2]int{{1, 3}, {2, 3}, {3, 3}}; !slices.Equal(progress, wantProgress) {
+		t.Fatalf("progress %v, want %v", progress, wantProgress)
+	}
+
+	plan, err = p.Plan(context.Background(), "example.com.", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+		{Type: "TXT", Name: "new", Value: "hello"},
+		{Type: "TXT", Name: "same", Value: "kept"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Empty() {
+		t.Fatalf("plan after Apply is %+v, want it empty", plan)
+	}
+}
+
+func TestPlanEqualFunc(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	p := box.provider()
+	desired := []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1", TTL: time.Hour}}
+
+	plan, err := p.Plan(context.Background(), "example.com", desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Empty() {
+		t.Fatalf("plan is %+v, want the TTL ignored", plan)
+	}
+
+	p.EqualFunc = EqualWithTTL
+	plan, err = p.Plan(context.Background(), "example.com", desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Updates) != 1 {
+		t.Fatalf("plan is %+v, want the record updated for its TTL", plan)
+	}
+}
+
+func TestApplyInvalidPlanWritesNothing(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	err := box.provider().Apply(context.Background(), ChangePlan{
+		Zone:    "example.com",
+		Updates: []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1"}},
+		Adds:    []libdns.Record{{Type: "A", Name: "bad", Value: "not-an-address"}},
+	})
+	if err == nil {
+		t.Fatal("Apply succeeded")
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q before failing", w)
+	}
+}
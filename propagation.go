@@ -0,0 +1,143 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// propagationInterval is how long WaitForPublicPropagation waits between
+// rounds of queries.
+const propagationInterval = 2 * time.Second
+
+// LookupFunc returns the values of the fqdn's records of recordType as the
+// DNS server sees them, formatted the way the box presents them.
+type LookupFunc func(ctx context.Context, server, fqdn, recordType string) ([]string, error)
+
+// WaitForPublicPropagation queries each of the given resolvers (host or
+// host:port, port 53 by default) until all of them return value for the
+// fqdn and record type, or until timeout elapses. A, AAAA, CNAME, MX, NS,
+// SRV and TXT records can be checked. It is WaitForPropagation with
+// PublicLookup.
+func WaitForPublicPropagation(ctx context.Context, fqdn, recordType, value string, resolvers []string, timeout time.Duration) error {
+	return WaitForPropagation(ctx, PublicLookup, fqdn, recordType, value, resolvers, timeout)
+}
+
+// WaitForPropagation asks lookup about the fqdn on each of the given
+// resolvers until all of them return value for the record type, or until
+// timeout elapses. Any way of resolving names can be plugged in as lookup.
+func WaitForPropagation(ctx context.Context, lookup LookupFunc, fqdn, recordType, value string, resolvers []string, timeout time.Duration) error {
+	if len(resolvers) == 0 {
+		return errors.New("no resolvers given to check propagation with")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rtype := miab.RecordType(strings.ToUpper(recordType))
+	want := normalizeValue(rtype, value)
+	pending := append([]string(nil), resolvers...)
+	for {
+		var lastErr error
+		remaining := pending[:0]
+		for _, server := range pending {
+			values, err := lookup(ctx, server, fqdn, string(rtype))
+			if errors.Is(err, ErrUnsupportedRecordType) {
+				return err
+			}
+			if err != nil {
+				lastErr = err
+			}
+			if !containsValue(values, rtype, want) {
+				remaining = append(remaining, server)
+			}
+		}
+		pending = remaining
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("%s %s not seen by %s: %w", fqdn, rtype, strings.Join(pending, ", "), lastErr)
+			}
+			return fmt.Errorf("%s %s not seen by %s: %w", fqdn, rtype, strings.Join(pending, ", "), ctx.Err())
+		case <-time.After(propagationInterval):
+		}
+	}
+}
+
+// PublicLookup is a LookupFunc that sends its queries over the network to
+// server, given as host or host:port, port 53 by default.
+func PublicLookup(ctx context.Context, server, fqdn, recordType string) ([]string, error) {
+	return lookup(ctx, resolverFor(server), fqdn, miab.RecordType(strings.ToUpper(recordType)))
+}
+
+// resolverFor returns a resolver that sends its queries to server.
+func resolverFor(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookup returns the values of the fqdn's records of rtype, formatted the
+// way the box presents them.
+func lookup(ctx context.Context, r *net.Resolver, fqdn string, rtype miab.RecordType) ([]string, error) {
+	var values []string
+	switch rtype {
+	case miab.A, miab.AAAA:
+		network := "ip4"
+		if rtype == miab.AAAA {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, fqdn)
+		for _, ip := range ips {
+			values = append(values, ip.String())
+		}
+		return values, err
+	case miab.CNAME:
+		cname, err := r.LookupCNAME(ctx, fqdn)
+		return []string{cname}, err
+	case miab.MX:
+		mxs, err := r.LookupMX(ctx, fqdn)
+		for _, mx := range mxs {
+			values = append(values, strconv.Itoa(int(mx.Pref))+" "+mx.Host)
+		}
+		return values, err
+	case miab.NS:
+		nss, err := r.LookupNS(ctx, fqdn)
+		for _, ns := range nss {
+			values = append(values, ns.Host)
+		}
+		return values, err
+	case miab.SRV:
+		_, srvs, err := r.LookupSRV(ctx, "", "", fqdn)
+		for _, srv := range srvs {
+			values = append(values, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+		return values, err
+	case miab.TXT:
+		return r.LookupTXT(ctx, fqdn)
+	}
+	return nil, fmt.Errorf("%w: cannot look up %s records", ErrUnsupportedRecordType, rtype)
+}
+
+func containsValue(values []string, rtype miab.RecordType, want string) bool {
+	for _, v := range values {
+		if normalizeValue(rtype, v) == want {
+			return true
+		}
+	}
+	return false
+}
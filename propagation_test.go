@@ -0,0 +1,49 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForPropagation(t *testing.T) {
+	seen := map[string][]string{
+		"ns1.example.net": {"192.0.2.1"},
+		"ns2.example.net": {"192.0.2.1", "192.0.2.2"},
+		"ns3.example.net": {"192.0.2.9"},
+	}
+	var queried []string
+	lookup := func(ctx context.Context, server, fqdn, recordType string) ([]string, error) {
+		if fqdn != "www.example.com" || recordType != "A" {
+			t.Errorf("looked up %s %s", fqdn, recordType)
+		}
+		queried = append(queried, server)
+		return seen[server], nil
+	}
+
+	err := WaitForPropagation(context.Background(), lookup, "www.example.com", "a", "192.0.2.1",
+		[]string{"ns1.example.net", "ns2.example.net"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queried) != 2 {
+		t.Fatalf("queried %q, want each resolver once", queried)
+	}
+
+	err = WaitForPropagation(context.Background(), lookup, "www.example.com", "A", "192.0.2.1",
+		[]string{"ns1.example.net", "ns3.example.net"}, 50*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+func TestWaitForPropagationNoResolvers(t *testing.T) {
+	lookup := func(ctx context.Context, server, fqdn, recordType string) ([]string, error) {
+		t.Fatal("lookup called without resolvers")
+		return nil, nil
+	}
+	if err := WaitForPropagation(context.Background(), lookup, "www.example.com", "A", "192.0.2.1", nil, time.Second); err == nil {
+		t.Fatal("WaitForPropagation succeeded without resolvers")
+	}
+}
@@ -1,15 +1,19 @@
 // Package miab implements a DNS record management client compatible
 // with the libdns interfaces for https://mailinabox.email/ custom DNS Endpoints.
-// The mailinabox DNS API is limited in that it only works with one zone.
+// The mailinabox DNS API only works with the zones hosted on the box.
 package mailinabox
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/libdns/libdns"
-	"github.com/luv2code/gomiabdns"
 	miab "github.com/luv2code/gomiabdns"
 )
 
@@ -25,95 +29,1229 @@ type Provider struct {
 	EmailAddress string `json:"email_address,omitempty"`
 	// Password of the admin account that corresponds to the email.
 	Password string `json:"password,omitempty"`
+	// DefaultZone is used by methods called with an empty zone, which
+	// saves single-zone users from passing it every time.
+	DefaultZone string `json:"default_zone,omitempty"`
+	// RequireExactZone only accepts zones the box controls exactly. By
+	// default a subdomain of a controlled zone is accepted as well.
+	RequireExactZone bool `json:"require_exact_zone,omitempty"`
+	// CredentialProvider, when set, is asked for fresh credentials every
+	// time a client is built, instead of using EmailAddress and Password.
+	CredentialProvider CredentialProvider `json:"-"`
+	// OnConvert, when set, is called with every record read from the box
+	// and the record it was converted to, or the reason it was skipped,
+	// such as an empty value or a duplicate.
+	OnConvert func(raw miab.DNSRecord, converted libdns.Record, err error) `json:"-"`
+	// Tracer, when set, wraps every API call in a span.
+	Tracer Tracer `json:"-"`
+	// EqualFunc, when set, decides whether a desired record matches a
+	// stored one when Plan compares a zone with desired records. Both have
+	// names relative to the zone. EqualValues is used by default, and
+	// EqualWithTTL is available for callers that care about TTLs.
+	EqualFunc func(a, b libdns.Record) bool `json:"-"`
+	// Progress, when set, is called by Apply after each change with the
+	// number of records applied so far and the number in the plan.
+	Progress func(done, total int) `json:"-"`
+	// Boxes routes zones to other boxes, keyed by zone suffix. A zone is
+	// handled by the entry with the longest matching suffix, or by the
+	// fields above when no entry matches.
+	Boxes map[string]BoxConfig `json:"boxes,omitempty"`
+	// MaxRecordsPerZone, when above zero, makes AppendRecords refuse to
+	// take a zone's custom records past this count. Records already on the
+	// box are not counted again.
+	MaxRecordsPerZone int `json:"max_records_per_zone,omitempty"`
+	// ErrorOnUnknownType makes reads fail on records of a type outside
+	// SupportedRecordTypes, instead of passing their raw value through.
+	ErrorOnUnknownType bool `json:"error_on_unknown_type,omitempty"`
+	// AllowApexDeletion lets DeleteRecords delete the NS and SOA records
+	// at the apex of a zone. They are protected by default.
+	AllowApexDeletion bool `json:"allow_apex_deletion,omitempty"`
+	// MaxBatchBytes, when above zero, makes AppendRecords, SetRecords and
+	// Apply refuse batches whose record names, types and values add up to
+	// more bytes than this, before making any call.
+	MaxBatchBytes int `json:"max_batch_bytes,omitempty"`
+	// StrictValidation rejects records that set fields the record type
+	// or the box cannot use, such as a Priority on an A record or a TTL,
+	// instead of ignoring them. It also rejects MX and SRV records missing
+	// their target, or their priority in both the value and Priority,
+	// instead of writing a priority of 0.
+	StrictValidation bool `json:"strict_validation,omitempty"`
+	// ValidateNames rejects record names that break the label rules of
+	// RFC 1035, such as labels over 63 characters or with characters
+	// other than letters, digits and hyphens, before writing them.
+	ValidateNames bool `json:"validate_names,omitempty"`
+	// MinCallBudget is the least time that must be left before the
+	// context deadline for a batch to start another API call; with less,
+	// the call would likely be cut off halfway, so the batch stops cleanly
+	// instead. It defaults to one second. A negative value disables the
+	// check, so calls are made until the deadline passes.
+	MinCallBudget time.Duration `json:"min_call_budget,omitempty"`
+	// AllowEmptyAppend makes AppendRecords with no records a no-op instead
+	// of returning ErrNoRecords.
+	AllowEmptyAppend bool `json:"allow_empty_append,omitempty"`
 }
 
-func (p *Provider) getClient() *miab.Client {
-	return miab.New(p.APIURL, p.EmailAddress, p.Password)
+// CredentialProvider supplies the admin credentials used to talk to the box.
+// It allows credentials to be rotated without restarting long-lived
+// processes.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (email, password string, err error)
 }
 
-func removeTrailingDot(zone string) string {
-	return zone[:len(zone)-1]
+// BoxConfig holds the connection settings of one Mail-In-A-Box.
+type BoxConfig struct {
+	APIURL       string `json:"api_url,omitempty"`
+	EmailAddress string `json:"email_address,omitempty"`
+	Password     string `json:"password,omitempty"`
 }
-func (p *Provider) zoneCheck(zone string) error {
-	zone = removeTrailingDot(zone)
-	if !strings.Contains(p.APIURL, removeTrailingDot(zone)) {
-		return fmt.Errorf("This DNS provider (%s) does not control the specified zone (%s)", p.APIURL, zone)
+
+// zoneLocks holds a lock per box and zone, serializing mutations. It is
+// shared by all Providers, so copies of a Provider, or separate Providers
+// for the same box, do not interleave their writes to a zone either.
+var zoneLocks sync.Map
+
+// lockZone serializes the mutations made to a zone, so that concurrent
+// batches do not interleave their reads and writes. Reads are not locked.
+// It returns the function that releases the lock, or the context error if
+// the context is done before the lock is acquired.
+func (p *Provider) lockZone(ctx context.Context, zone string) (func(), error) {
+	lock, _ := zoneLocks.LoadOrStore(p.apiURL(zone)+" "+zone, make(chan struct{}, 1))
+	ch := lock.(chan struct{})
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return nil
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// zoneOrDefault returns the normalized zone argument, or DefaultZone when
+// the argument is empty.
+func (p *Provider) zoneOrDefault(zone string) string {
+	if zone == "" {
+		zone = p.DefaultZone
+	}
+	return normalizeZone(zone)
+}
+
+// route returns the box responsible for zone: the entry of Boxes with the
+// longest zone suffix matching it, if any.
+func (p *Provider) route(zone string) (BoxConfig, bool) {
+	var box BoxConfig
+	match := ""
+	for suffix, b := range p.Boxes {
+		suffix = normalizeZone(suffix)
+		if (zone == suffix || strings.HasSuffix(zone, "."+suffix)) && len(suffix) > len(match) {
+			box, match = b, suffix
+		}
+	}
+	return box, match != ""
+}
+
+// apiURL returns the API URL of the box responsible for zone.
+func (p *Provider) apiURL(zone string) string {
+	if box, ok := p.route(zone); ok {
+		return box.APIURL
+	}
+	return p.APIURL
+}
+
+// credentialsKey is the context key under which WithCredentials stores
+// credentials.
+type credentialsKey struct{}
+
+type credentials struct {
+	email, password string
+}
+
+// WithCredentials returns a context that makes the provider calls it is
+// passed to authenticate with email and password, instead of the
+// credentials configured on the Provider or its Boxes. It lets one
+// Provider act for several admin accounts.
+func WithCredentials(ctx context.Context, email, password string) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials{email, password})
+}
+
+func (p *Provider) getClient(ctx context.Context, zone string) (*miab.Client, error) {
+	if c, ok := ctx.Value(credentialsKey{}).(credentials); ok {
+		return miab.New(p.apiURL(zone), c.email, c.password), nil
+	}
+	if box, ok := p.route(zone); ok {
+		return miab.New(box.APIURL, box.EmailAddress, box.Password), nil
+	}
+	if p.CredentialProvider == nil {
+		return miab.New(p.APIURL, p.EmailAddress, p.Password), nil
+	}
+	email, password, err := p.CredentialProvider.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return miab.New(p.APIURL, email, password), nil
+}
+
+// RawClient returns the gomiabdns client the provider would use for
+// DefaultZone, for API calls this provider does not wrap. It is built the
+// same way as for the provider's own calls, so Boxes, CredentialProvider
+// and credentials set with WithCredentials on ctx apply. The client is not
+// covered by this package's compatibility promise: it bypasses zone checks,
+// validation and normalization, and its API may change with gomiabdns.
+func (p *Provider) RawClient(ctx context.Context) (*miab.Client, error) {
+	return p.getClient(ctx, p.zoneOrDefault(""))
+}
+
+// supportedRecordTypes are the record types the Mail-In-A-Box custom DNS
+// API accepts.
+var supportedRecordTypes = []miab.RecordType{
+	miab.A,
+	miab.AAAA,
+	miab.CAA,
+	miab.CNAME,
+	miab.MX,
+	miab.NS,
+	miab.SRV,
+	miab.SSHFP,
+	miab.TXT,
+}
+
+// SupportedRecordTypes returns the record types that can be managed with
+// this provider, including those added with RegisterConverter.
+func SupportedRecordTypes() []string {
+	types := make([]string, len(supportedRecordTypes))
+	for i, t := range supportedRecordTypes {
+		types[i] = string(t)
+	}
+	return append(types, registeredTypes()...)
+}
+
+// builtinType reports whether rtype is one of supportedRecordTypes.
+func builtinType(rtype miab.RecordType) bool {
+	for _, t := range supportedRecordTypes {
+		if strings.EqualFold(string(rtype), string(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeZone brings the zone argument into the canonical form used
+// throughout the provider: lowercase and without the trailing dot. Every
+// exported method normalizes its zone on entry, and the zones reported by
+// the box go through the same function, so they can be compared directly.
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, "."))
+}
+
+// ErrProtectedRecord is returned when deleting the NS or SOA records at the
+// apex of a zone, which would break the zone, unless AllowApexDeletion is set.
+var ErrProtectedRecord = errors.New("refusing to delete apex record")
+
+// ErrNoRecords is returned by AppendRecords when it is given no records,
+// which usually points to a bug in the caller, unless AllowEmptyAppend is set.
+var ErrNoRecords = errors.New("no records given")
+
+// ErrNameOutsideZone is returned when a record name is fully qualified but
+// does not belong to the zone the operation was called with.
+var ErrNameOutsideZone = errors.New("record name is outside the zone")
+
+// qualifiedName builds the name a record is written under on the box. The
+// zone passed to an operation is authoritative: relative names are always
+// placed under it, and fully qualified names (ending in a dot) must already
+// belong to it.
+func qualifiedName(name, zone string) (string, error) {
+	if name == "" || name == "@" {
+		return zone, nil
+	}
+	if !strings.HasSuffix(name, ".") {
+		return canonicalName(name + "." + zone), nil
+	}
+	name = canonicalName(name)
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		return "", fmt.Errorf("%w: %s is not in %s", ErrNameOutsideZone, name, zone)
+	}
+	return name, nil
+}
+
+// canonicalName is the form qualified names are compared in: lowercase,
+// as DNS names are case-insensitive, and without the trailing dot. Names
+// read from the box and names about to be written both go through it.
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
 }
-func toLibDnsRecords(zone string, miabRecords []miab.DNSRecord) []libdns.Record {
+
+func (p *Provider) toLibDnsRecords(zone string, miabRecords []miab.DNSRecord) ([]libdns.Record, error) {
 	libDNSRecords := []libdns.Record{}
-	zone = removeTrailingDot(zone)
+	err := p.convertRecords(zone, miabRecords, func(r libdns.Record) bool {
+		libDNSRecords = append(libDNSRecords, r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return libDNSRecords, nil
+}
+
+// convertRecords converts the records of the box that belong to zone one at
+// a time, passing each to yield until it returns false. It only fails for
+// records of unknown types when ErrorOnUnknownType is set.
+func (p *Provider) convertRecords(zone string, miabRecords []miab.DNSRecord, yield func(libdns.Record) bool) error {
+	seen := make(map[[3]string]bool)
 	for _, mr := range miabRecords {
-		partialName := strings.ReplaceAll(mr.QualifiedName, zone, "")
-		partialName = removeTrailingDot(partialName)
-		libDNSRecords = append(libDNSRecords, libdns.Record{
-			ID:    mr.QualifiedName + ".",
-			Type:  string(mr.RecordType),
-			Name:  partialName,
-			Value: mr.Value,
-		})
+		// The box lists the records of all its zones. Only those at
+		// or below the requested zone are relative to it.
+		if !inZone(mr.QualifiedName, zone) {
+			continue
+		}
+		r, err := toLibDnsRecord(zone, mr)
+		if err == nil {
+			// Some versions of the box list a record more than once.
+			key := [3]string{r.Name, r.Type, r.Value}
+			if seen[key] {
+				err = fmt.Errorf("record %s (%s) is a duplicate", mr.QualifiedName, mr.RecordType)
+			}
+			seen[key] = true
+		}
+		var typeErr error
+		if err == nil && p.ErrorOnUnknownType {
+			typeErr = checkType(r)
+			err = typeErr
+		}
+		if p.OnConvert != nil {
+			p.OnConvert(mr, r, err)
+		}
+		if typeErr != nil {
+			return fmt.Errorf("record %s: %w", mr.QualifiedName, typeErr)
+		}
+		if err != nil {
+			continue
+		}
+		if !yield(r) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ToMIABRecords converts libdns records into the records the box stores for
+// them in zone, for use with the gomiabdns client directly. Records are
+// validated the same way as when they are written by the provider.
+func ToMIABRecords(zone string, records []libdns.Record) ([]miab.DNSRecord, error) {
+	zone = normalizeZone(zone)
+	miabRecords := make([]miab.DNSRecord, 0, len(records))
+	for _, r := range records {
+		mr, err := toMIABRecord(zone, r)
+		if err != nil {
+			return nil, err
+		}
+		miabRecords = append(miabRecords, mr)
+	}
+	return miabRecords, nil
+}
+
+// inZone reports whether the qualified name belongs to zone.
+func inZone(qualifiedName, zone string) bool {
+	return qualifiedName == zone || strings.HasSuffix(qualifiedName, "."+zone)
+}
+
+// prepareRecord converts a record about to be written, applying the
+// provider's validation settings on top of the checks every write gets.
+func (p *Provider) prepareRecord(zone string, r libdns.Record) (miab.DNSRecord, error) {
+	if p.StrictValidation {
+		// Check the record as the caller gave it, before a missing
+		// priority is filled in.
+		name, err := qualifiedName(r.Name, zone)
+		if err != nil {
+			return miab.DNSRecord{}, err
+		}
+		if err := checkStrict(name, r); err != nil {
+			return miab.DNSRecord{}, err
+		}
+	}
+	mr, err := toMIABRecord(zone, r)
+	if err != nil {
+		return mr, err
+	}
+	if p.ValidateNames {
+		if err := checkName(mr.QualifiedName, mr.RecordType); err != nil {
+			return miab.DNSRecord{}, err
+		}
+	}
+	return mr, nil
+}
+
+// prepareRecords runs prepareRecord on every record, failing on the first
+// invalid one.
+func (p *Provider) prepareRecords(zone string, records []libdns.Record) ([]miab.DNSRecord, error) {
+	mrs := make([]miab.DNSRecord, len(records))
+	for i, r := range records {
+		mr, err := p.prepareRecord(zone, r)
+		if err != nil {
+			return nil, err
+		}
+		mrs[i] = mr
+	}
+	return mrs, nil
+}
+
+func toMIABRecord(zone string, r libdns.Record) (miab.DNSRecord, error) {
+	name, err := qualifiedName(r.Name, zone)
+	if err != nil {
+		return miab.DNSRecord{}, err
+	}
+	rtype := miab.RecordType(strings.ToUpper(r.Type))
+	if c, ok := lookupConverter(rtype); ok {
+		value, err := c.toMIAB(r, zone)
+		if err != nil {
+			return miab.DNSRecord{}, err
+		}
+		return miab.DNSRecord{QualifiedName: name, RecordType: rtype, Value: value, Zone: zone}, nil
+	}
+	if r.Value, err = formatValue(r); err != nil {
+		return miab.DNSRecord{}, err
+	}
+	if err := checkRecord(name, r); err != nil {
+		return miab.DNSRecord{}, err
 	}
-	return libDNSRecords
+	return miab.DNSRecord{
+		QualifiedName: name,
+		RecordType:    rtype,
+		Value:         normalizeValue(rtype, r.Value),
+		Zone:          zone,
+	}, nil
 }
 
-// GetRecords lists all the records in the zone.
+// sortRecords orders records by name, type and value, so results do not
+// depend on the order the box returned them in.
+func sortRecords(records []libdns.Record) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+}
+
+func toLibDnsRecord(zone string, mr miab.DNSRecord) (libdns.Record, error) {
+	if c, ok := lookupConverter(mr.RecordType); ok {
+		return c.toLibDNS(mr, zone)
+	}
+	// A record without a value cannot be written back and is not
+	// meaningful to callers, so it is left out.
+	if strings.TrimSpace(mr.Value) == "" {
+		return libdns.Record{}, fmt.Errorf("record %s (%s) has an empty value", mr.QualifiedName, mr.RecordType)
+	}
+	r := libdns.Record{
+		ID:    mr.QualifiedName + ".",
+		Type:  string(mr.RecordType),
+		Name:  relativeName(mr.QualifiedName, zone),
+		Value: normalizeValue(mr.RecordType, mr.Value),
+	}
+	if mr.RecordType == miab.MX || mr.RecordType == miab.SRV {
+		// The value keeps its leading priority field, which is also
+		// exposed as Priority.
+		if fields := strings.Fields(r.Value); len(fields) > 0 {
+			r.Priority, _ = strconv.Atoi(fields[0])
+		}
+	}
+	return r, nil
+}
+
+// relativeName returns qname relative to zone, "" for the apex. Unlike
+// libdns.RelativeName it only strips whole labels.
+func relativeName(qname, zone string) string {
+	if qname == zone {
+		return ""
+	}
+	return strings.TrimSuffix(qname, "."+zone)
+}
+
+// priorityFields is the number of fields in the full value of each
+// priority-bearing record type, priority included.
+var priorityFields = map[miab.RecordType]int{
+	miab.MX:  2, // preference target
+	miab.SRV: 4, // priority weight port target
+}
+
+// formatValue builds the value the box expects for r. For MX and SRV records
+// the priority can be given in the Priority field instead of at the start of
+// the value, in which case it is added to the value.
+func formatValue(r libdns.Record) (string, error) {
+	value := strings.TrimSpace(r.Value)
+	n, ok := priorityFields[miab.RecordType(strings.ToUpper(r.Type))]
+	if !ok || len(strings.Fields(value)) != n-1 {
+		return value, nil
+	}
+	if r.Priority < 0 || r.Priority > 65535 {
+		return "", fmt.Errorf("priority %d of %s record %s is out of range", r.Priority, r.Type, r.Name)
+	}
+	return strconv.Itoa(r.Priority) + " " + value, nil
+}
+
+// GetRecords lists all the records in the zone. Only the custom records
+// set through the API or the admin panel are returned; the records the box
+// generates itself, such as its MX, SPF and DKIM records, are not exposed
+// by the custom DNS endpoints.
 func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
-	if err := p.zoneCheck(zone); err != nil {
+	zone = p.zoneOrDefault(zone)
+	if _, err := p.zoneCheck(ctx, zone); err != nil {
+		return nil, err
+	}
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
 		return nil, err
 	}
-	client := p.getClient()
-	miabRecords, err := client.GetHosts(ctx, "", "")
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
 	if err != nil {
 		return nil, err
 	}
-	return toLibDnsRecords(zone, miabRecords), nil
+	records, err := p.toLibDnsRecords(zone, miabRecords)
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records)
+	return records, nil
 }
 
 // AppendRecords adds records to the zone. It returns the records that were added.
+// When the context deadline is too close to start another call, it stops and
+// returns the records added so far together with the context error.
+// Records are created one at a time, in the order given, so dependent records
+// can be listed after the records they rely on.
+// An empty slice of records returns ErrNoRecords unless AllowEmptyAppend is set.
 func (p *Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	if err := p.zoneCheck(zone); err != nil {
+	if len(records) == 0 {
+		if p.AllowEmptyAppend {
+			return []libdns.Record{}, nil
+		}
+		return nil, ErrNoRecords
+	}
+	if err := p.checkBatchSize(records); err != nil {
 		return nil, err
 	}
-	zone = removeTrailingDot(zone)
-	client := p.getClient()
-	for _, r := range records {
-		if err := client.AddHost(ctx, r.Name+"."+zone, gomiabdns.RecordType(r.Type), r.Value); err != nil {
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	current, err := p.storedRRSets(ctx, client, zone)
+	if err != nil {
+		return nil, err
+	}
+	return p.appendRecords(ctx, client, zone, controlled, current, records)
+}
+
+// appendRecords adds records to the zone, whose stored record sets are
+// current, and keeps current up to date as it goes. The zone lock must be
+// held.
+func (p *Provider) appendRecords(ctx context.Context, client *miab.Client, zone, controlled string, current map[[2]string]map[string]string, records []libdns.Record) ([]libdns.Record, error) {
+	// Validate the whole batch before writing anything, so bad input
+	// never leaves the zone half updated.
+	mrs := make([]miab.DNSRecord, len(records))
+	planned := cloneRRSets(current)
+	adding := 0
+	for i, r := range records {
+		mr, err := p.prepareRecord(zone, r)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCNAMEConflict(planned, mr.QualifiedName, mr.RecordType, mr.Value); err != nil {
 			return nil, err
 		}
+		// Adding a value the box already holds is a no-op, so only
+		// new values count towards MaxRecordsPerZone.
+		if _, ok := planned[[2]string{mr.QualifiedName, string(mr.RecordType)}][mr.Value]; !ok {
+			adding++
+		}
+		addToRRSets(planned, mr)
+		mrs[i] = mr
+	}
+	if p.MaxRecordsPerZone > 0 {
+		count := countInZone(current, controlled)
+		if count+adding > p.MaxRecordsPerZone {
+			return nil, &ZoneFullError{Zone: controlled, Count: count, Adding: adding, Max: p.MaxRecordsPerZone}
+		}
+	}
+	for i, mr := range mrs {
+		if err := p.checkBudget(ctx); err != nil {
+			return records[:i], err
+		}
+		if err := p.addHost(ctx, client, zone, mr); err != nil {
+			return records[:i], err
+		}
+		addToRRSets(current, mr)
 	}
 	return records, nil
 }
 
 // SetRecords sets the records in the zone, either by updating existing records or creating new ones.
-// It returns the updated records.
+// The records given for a name and type replace all of its values. Within each
+// name and type, missing values are added before stale ones are deleted, so the
+// name is never left without records, though the change is not atomic.
+// Records that already match what is stored on the box are not written again.
+// Like AppendRecords, it stops early when the context deadline is near.
+// It returns the records of the names and types that were set, as stored on
+// the box after the update.
 func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	if err := p.zoneCheck(zone); err != nil {
+	if err := p.checkBatchSize(records); err != nil {
+		return nil, err
+	}
+	zone = p.zoneOrDefault(zone)
+	// Prepare every record before writing, so that an invalid record
+	// fails the whole call and records naming the same set in different
+	// ways are grouped together.
+	sets, err := p.prepareRRSets(zone, records)
+	if err != nil {
 		return nil, err
 	}
-	zone = removeTrailingDot(zone)
-	client := p.getClient()
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	current, err := p.storedRRSets(ctx, client, zone)
+	if err != nil {
+		return nil, err
+	}
+	if done, err := p.setRRSets(ctx, client, zone, current, sets); err != nil {
+		return done, err
+	}
+	set := make(map[[2]string]bool, len(sets))
+	for _, rs := range sets {
+		set[rs.key] = true
+	}
+	// Return what the box stored, which may differ from the input
+	// after the box normalized it.
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+	if err != nil {
+		return nil, err
+	}
+	var setRecords []miab.DNSRecord
+	for _, mr := range miabRecords {
+		if set[[2]string{mr.QualifiedName, string(mr.RecordType)}] {
+			setRecords = append(setRecords, mr)
+		}
+	}
+	return p.toLibDnsRecords(zone, setRecords)
+}
+
+// rrSet holds the records given for one qualified name and type, and
+// their prepared forms without duplicate values.
+type rrSet struct {
+	key     [2]string
+	records []libdns.Record
+	mrs     []miab.DNSRecord
+}
+
+// prepareRRSets prepares records for writing and groups them into record
+// sets by qualified name and type, in the order each set first appears.
+func (p *Provider) prepareRRSets(zone string, records []libdns.Record) ([]*rrSet, error) {
+	var sets []*rrSet
+	index := make(map[[2]string]*rrSet)
 	for _, r := range records {
-		if err := client.UpdateHost(ctx, r.Name+"."+zone, gomiabdns.RecordType(r.Type), r.Value); err != nil {
+		mr, err := p.prepareRecord(zone, r)
+		if err != nil {
 			return nil, err
 		}
+		key := [2]string{mr.QualifiedName, string(mr.RecordType)}
+		rs, ok := index[key]
+		if !ok {
+			rs = &rrSet{key: key}
+			index[key] = rs
+			sets = append(sets, rs)
+		}
+		rs.records = append(rs.records, r)
+		if !hasValue(rs.mrs, mr.Value) {
+			rs.mrs = append(rs.mrs, mr)
+		}
 	}
-	return records, nil
+	return sets, nil
+}
+
+// hasValue reports whether one of mrs has the given value.
+func hasValue(mrs []miab.DNSRecord, value string) bool {
+	for _, mr := range mrs {
+		if mr.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// setRRSets writes each record set with setRRSet, given the stored sets.
+// It returns the records of the sets fully written.
+func (p *Provider) setRRSets(ctx context.Context, client *miab.Client, zone string, current map[[2]string]map[string]string, sets []*rrSet) ([]libdns.Record, error) {
+	var done []libdns.Record
+	for _, rs := range sets {
+		if err := p.setRRSet(ctx, client, zone, rs.mrs, current[rs.key]); err != nil {
+			return done, err
+		}
+		done = append(done, rs.records...)
+	}
+	return done, nil
+}
+
+// setRRSet makes the values of one name and type those of mrs, given the
+// values stored now. New values are added before stale ones are deleted, so
+// the name keeps resolving throughout; the API offers no way to do it
+// atomically. A CNAME, which cannot hold two values even briefly, is
+// replaced in a single call instead.
+func (p *Provider) setRRSet(ctx context.Context, client *miab.Client, zone string, mrs []miab.DNSRecord, stored map[string]string) error {
+	if len(mrs) == 1 && mrs[0].RecordType == miab.CNAME {
+		if _, ok := stored[mrs[0].Value]; ok && len(stored) == 1 {
+			return nil
+		}
+		if err := p.checkBudget(ctx); err != nil {
+			return err
+		}
+		return p.updateHost(ctx, client, zone, mrs[0])
+	}
+	wanted := make(map[string]bool, len(mrs))
+	for _, mr := range mrs {
+		wanted[mr.Value] = true
+		if _, ok := stored[mr.Value]; ok {
+			continue
+		}
+		if err := p.checkBudget(ctx); err != nil {
+			return err
+		}
+		if err := p.addHost(ctx, client, zone, mr); err != nil {
+			return err
+		}
+	}
+	for value, raw := range stored {
+		if wanted[value] {
+			continue
+		}
+		if err := p.checkBudget(ctx); err != nil {
+			return err
+		}
+		mr := miab.DNSRecord{QualifiedName: mrs[0].QualifiedName, RecordType: mrs[0].RecordType, Value: raw}
+		if err := p.deleteHost(ctx, client, zone, mr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // DeleteRecords deletes the records from the zone. It returns the records that were deleted.
+// Like AppendRecords, it stops early when the context deadline is near, and
+// then returns the records deleted so far together with the error.
 func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	if err := p.zoneCheck(zone); err != nil {
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
 		return nil, err
 	}
-	zone = removeTrailingDot(zone)
-	client := p.getClient()
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	return p.deleteRecords(ctx, client, zone, records)
+}
+
+// deleteRecords deletes records from the zone and returns those it
+// deleted, which are all of them unless it fails partway.
+func (p *Provider) deleteRecords(ctx context.Context, client *miab.Client, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	if err := p.checkDeletes(zone, records); err != nil {
+		return nil, err
+	}
+	var deleted []libdns.Record
+	for _, group := range groupByNameAndType(records) {
+		name, err := qualifiedName(group[0].Name, zone)
+		if err != nil {
+			return deleted, err
+		}
+		rtype := miab.RecordType(strings.ToUpper(group[0].Type))
+		if err := p.checkBudget(ctx); err != nil {
+			return deleted, err
+		}
+		// The stored values are only needed to find out whether the
+		// group covers the whole set, or how the box spells a value the
+		// caller gave in another form. A single value already in the
+		// box's form is deleted without looking it up.
+		var stored map[string]string
+		if len(group) > 1 || group[0].Value != normalizeValue(rtype, group[0].Value) {
+			stored, err = p.storedValues(ctx, client, zone, name, rtype)
+			if err != nil {
+				return deleted, err
+			}
+		}
+		// When the group covers every value of the name and type,
+		// the whole set can be removed with a single call.
+		if len(group) > 1 && coversRRSet(stored, rtype, group) {
+			if err := p.deleteHost(ctx, client, zone, miab.DNSRecord{QualifiedName: name, RecordType: rtype}); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, group...)
+			continue
+		}
+		for _, r := range group {
+			if err := p.checkBudget(ctx); err != nil {
+				return deleted, err
+			}
+			// The box only deletes exact matches, so send the value
+			// as it is stored rather than as the caller spelled it.
+			value := r.Value
+			if raw, ok := stored[normalizeValue(rtype, value)]; ok {
+				value = raw
+			}
+			if err := p.deleteHost(ctx, client, zone, miab.DNSRecord{QualifiedName: name, RecordType: rtype, Value: value}); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, r)
+		}
+	}
+	return deleted, nil
+}
+
+// checkDeletes verifies that every record can be deleted from the zone,
+// before any of them is.
+func (p *Provider) checkDeletes(zone string, records []libdns.Record) error {
 	for _, r := range records {
-		if err := client.DeleteHost(ctx, r.Name+"."+zone, gomiabdns.RecordType(r.Type), r.Value); err != nil {
-			return nil, err
+		name, err := qualifiedName(r.Name, zone)
+		if err != nil {
+			return err
+		}
+		if rtype := miab.RecordType(strings.ToUpper(r.Type)); p.protected(name, zone, rtype) {
+			return fmt.Errorf("%w: %s %s", ErrProtectedRecord, rtype, name)
 		}
 	}
-	return records, nil
+	return nil
+}
+
+// protected reports whether the record set is one DeleteRecords refuses to
+// delete: the NS or SOA records at the apex, unless AllowApexDeletion is set.
+func (p *Provider) protected(name, zone string, rtype miab.RecordType) bool {
+	return name == zone && (rtype == miab.NS || rtype == "SOA") && !p.AllowApexDeletion
+}
+
+// Tracer starts a span around each API call the provider makes. It can be
+// backed by OpenTelemetry or any other tracing system without this package
+// depending on it. The span starts with the operation, zone, name and
+// record type of the call. The returned function ends the span with the
+// attributes known once the call is done, "dns.status" being "ok" or
+// "error", and the error of the call, if any.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(attrs map[string]string, err error))
+}
+
+// startSpan starts a span for an API call about zone if a Tracer is set.
+func (p *Provider) startSpan(ctx context.Context, op, zone string, mr miab.DNSRecord) (context.Context, func(error)) {
+	if p.Tracer == nil {
+		return ctx, func(error) {}
+	}
+	ctx, end := p.Tracer.StartSpan(ctx, "mailinabox."+op, map[string]string{
+		"dns.operation":   op,
+		"dns.zone":        zone,
+		"dns.name":        mr.QualifiedName,
+		"dns.record_type": string(mr.RecordType),
+	})
+	return ctx, func(err error) {
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		end(map[string]string{"dns.status": status}, err)
+	}
+}
+
+// getHosts lists records on the box, all of them when name is empty. The
+// box may store names in the case they were written in, so qualified names
+// are brought into the same canonical form as names built by qualifiedName,
+// see boxQualifiedName.
+func (p *Provider) getHosts(ctx context.Context, client *miab.Client, zone, name string, rtype miab.RecordType) ([]miab.DNSRecord, error) {
+	ctx, end := p.startSpan(ctx, "GetHosts", zone, miab.DNSRecord{QualifiedName: name, RecordType: rtype})
+	miabRecords, err := client.GetHosts(ctx, name, rtype)
+	end(err)
+	for i := range miabRecords {
+		miabRecords[i].QualifiedName = boxQualifiedName(miabRecords[i])
+	}
+	return miabRecords, err
+}
+
+// boxQualifiedName returns the canonical qualified name of a record read
+// from the box. Box versions differ in whether the name has a trailing dot,
+// and some list names relative to the record's zone, which are completed
+// with it.
+func boxQualifiedName(mr miab.DNSRecord) string {
+	name := canonicalName(mr.QualifiedName)
+	zone := normalizeZone(mr.Zone)
+	if zone == "" || inZone(name, zone) {
+		return name
+	}
+	if name == "" || name == "@" {
+		return zone
+	}
+	return name + "." + zone
+}
+
+// addHost, updateHost and deleteHost make a single write call and describe
+// the record it was about when it fails, so a failure within a batch can be
+// traced back. Only the length of the value is given, as it may be secret.
+
+func (p *Provider) addHost(ctx context.Context, client *miab.Client, zone string, mr miab.DNSRecord) error {
+	ctx, end := p.startSpan(ctx, "AddHost", zone, mr)
+	err := client.AddHost(ctx, mr.QualifiedName, mr.RecordType, mr.Value)
+	end(err)
+	if err != nil {
+		return writeError("adding", mr, err)
+	}
+	return nil
+}
+
+func (p *Provider) updateHost(ctx context.Context, client *miab.Client, zone string, mr miab.DNSRecord) error {
+	ctx, end := p.startSpan(ctx, "UpdateHost", zone, mr)
+	err := client.UpdateHost(ctx, mr.QualifiedName, mr.RecordType, mr.Value)
+	end(err)
+	if err != nil {
+		return writeError("updating", mr, err)
+	}
+	return nil
+}
+
+func (p *Provider) deleteHost(ctx context.Context, client *miab.Client, zone string, mr miab.DNSRecord) error {
+	ctx, end := p.startSpan(ctx, "DeleteHost", zone, mr)
+	err := client.DeleteHost(ctx, mr.QualifiedName, mr.RecordType, mr.Value)
+	end(err)
+	if err != nil {
+		return writeError("deleting", mr, err)
+	}
+	return nil
+}
+
+func writeError(op string, mr miab.DNSRecord, err error) error {
+	return fmt.Errorf("%s %s record %s (value of %d bytes): %w", op, mr.RecordType, mr.QualifiedName, len(mr.Value), err)
+}
+
+// defaultMinCallBudget is the MinCallBudget used when it is not set.
+const defaultMinCallBudget = time.Second
+
+// checkBudget reports whether there is still time to make another API call
+// within the context deadline.
+func (p *Provider) checkBudget(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	budget := p.MinCallBudget
+	if budget == 0 {
+		budget = defaultMinCallBudget
+	}
+	if deadline, ok := ctx.Deadline(); ok && budget > 0 && time.Until(deadline) < budget {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// groupByNameAndType splits records into groups sharing a name and type,
+// keeping the order in which each group first appears.
+func groupByNameAndType(records []libdns.Record) [][]libdns.Record {
+	var groups [][]libdns.Record
+	index := make(map[[2]string]int)
+	for _, r := range records {
+		key := [2]string{r.Name, r.Type}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], r)
+	}
+	return groups
+}
+
+// storedValues returns the values the box holds for name and rtype, keyed
+// by their normalized form.
+func (p *Provider) storedValues(ctx context.Context, client *miab.Client, zone, name string, rtype miab.RecordType) (map[string]string, error) {
+	current, err := p.getHosts(ctx, client, zone, name, rtype)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]string, len(current))
+	for _, mr := range current {
+		stored[normalizeValue(rtype, mr.Value)] = mr.Value
+	}
+	return stored, nil
+}
+
+// storedRRSets returns the values of every record on the box, grouped by
+// qualified name and type and keyed by their normalized form.
+func (p *Provider) storedRRSets(ctx context.Context, client *miab.Client, zone string) (map[[2]string]map[string]string, error) {
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return rrSetsOf(miabRecords), nil
+}
+
+// rrSetsOf groups records read from the box the way storedRRSets does.
+func rrSetsOf(miabRecords []miab.DNSRecord) map[[2]string]map[string]string {
+	rrsets := make(map[[2]string]map[string]string)
+	for _, mr := range miabRecords {
+		key := [2]string{mr.QualifiedName, string(mr.RecordType)}
+		if rrsets[key] == nil {
+			rrsets[key] = make(map[string]string)
+		}
+		rrsets[key][normalizeValue(mr.RecordType, mr.Value)] = mr.Value
+	}
+	return rrsets
+}
+
+// addToRRSets records mr in rrsets, as returned by storedRRSets.
+func addToRRSets(rrsets map[[2]string]map[string]string, mr miab.DNSRecord) {
+	key := [2]string{mr.QualifiedName, string(mr.RecordType)}
+	if rrsets[key] == nil {
+		rrsets[key] = make(map[string]string)
+	}
+	rrsets[key][mr.Value] = mr.Value
+}
+
+// cloneRRSets returns a copy of rrsets that can be changed independently.
+func cloneRRSets(rrsets map[[2]string]map[string]string) map[[2]string]map[string]string {
+	clone := make(map[[2]string]map[string]string, len(rrsets))
+	for key, values := range rrsets {
+		clone[key] = make(map[string]string, len(values))
+		for v, raw := range values {
+			clone[key][v] = raw
+		}
+	}
+	return clone
+}
+
+// ZoneFullError is returned when appending records would take a zone past
+// MaxRecordsPerZone.
+type ZoneFullError struct {
+	Zone   string
+	Count  int
+	Adding int
+	Max    int
+}
+
+func (e *ZoneFullError) Error() string {
+	return fmt.Sprintf("zone %s holds %d records; adding %d would exceed the limit of %d",
+		e.Zone, e.Count, e.Adding, e.Max)
+}
+
+// countInZone returns how many of the stored records belong to zone.
+func countInZone(rrsets map[[2]string]map[string]string, zone string) int {
+	count := 0
+	for key, values := range rrsets {
+		if inZone(key[0], zone) {
+			count += len(values)
+		}
+	}
+	return count
+}
+
+// CNAMEConflictError is returned when appending a record would leave a
+// CNAME next to other records of the same name, which DNS does not allow.
+type CNAMEConflictError struct {
+	Name         string
+	Type         string
+	ExistingType string
+}
+
+func (e *CNAMEConflictError) Error() string {
+	return fmt.Sprintf("cannot add %s record to %s: a %s record already exists and a CNAME cannot coexist with other records",
+		e.Type, e.Name, e.ExistingType)
+}
+
+// checkCNAMEConflict reports whether adding a record of rtype and value
+// under name would conflict with a CNAME in rrsets, or add a CNAME next to
+// existing records.
+func checkCNAMEConflict(rrsets map[[2]string]map[string]string, name string, rtype miab.RecordType, value string) error {
+	for key, values := range rrsets {
+		existing := miab.RecordType(key[1])
+		if key[0] != name || len(values) == 0 || (rtype != miab.CNAME && existing != miab.CNAME) {
+			continue
+		}
+		if _, ok := values[value]; ok && rtype == existing {
+			continue
+		}
+		return &CNAMEConflictError{Name: name, Type: string(rtype), ExistingType: string(existing)}
+	}
+	return nil
+}
+
+// coversRRSet reports whether group holds every stored value.
+func coversRRSet(stored map[string]string, rtype miab.RecordType, group []libdns.Record) bool {
+	values := make(map[string]bool, len(group))
+	for _, r := range group {
+		values[normalizeValue(rtype, r.Value)] = true
+	}
+	for v := range stored {
+		if !values[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// PruneAcmeChallenges deletes the _acme-challenge TXT records left behind in
+// the zone by ACME DNS challenges and returns how many were removed.
+// The Mail-In-A-Box API does not expose when a record was created, so
+// olderThan cannot be honored yet and every challenge record is removed.
+func (p *Provider) PruneAcmeChallenges(ctx context.Context, zone string, olderThan time.Duration) (int, error) {
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return 0, err
+	}
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, mr := range miabRecords {
+		if mr.RecordType != miab.TXT || !isAcmeChallenge(mr.QualifiedName, zone) {
+			continue
+		}
+		if err := p.deleteHost(ctx, client, zone, mr); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func isAcmeChallenge(qualifiedName, zone string) bool {
+	if !strings.HasPrefix(qualifiedName, "_acme-challenge.") {
+		return false
+	}
+	return qualifiedName == "_acme-challenge."+zone || strings.HasSuffix(qualifiedName, "."+zone)
+}
+
+// RecordExists reports whether a record with the given name, type and value
+// exists in the zone. An empty value matches any record of that name and type.
+func (p *Provider) RecordExists(ctx context.Context, zone, name, recordType, value string) (bool, error) {
+	zone = p.zoneOrDefault(zone)
+	if _, err := p.zoneCheck(ctx, zone); err != nil {
+		return false, err
+	}
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	rtype := miab.RecordType(strings.ToUpper(recordType))
+	qname, err := qualifiedName(name, zone)
+	if err != nil {
+		return false, err
+	}
+	miabRecords, err := p.getHosts(ctx, client, zone, qname, rtype)
+	if err != nil {
+		return false, err
+	}
+	for _, mr := range miabRecords {
+		if mr.RecordType != rtype {
+			continue
+		}
+		if value == "" || normalizeValue(rtype, mr.Value) == normalizeValue(rtype, value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// normalizeValue brings a record value into a canonical form so values
+// read from the box can be compared with values supplied by callers. The
+// same form is used when writing, so a record that is read and written
+// back unchanged keeps its exact value.
+func normalizeValue(rtype miab.RecordType, value string) string {
+	value = strings.TrimSpace(value)
+	switch rtype {
+	case miab.CNAME, miab.NS:
+		return normalizeTarget(value)
+	case miab.TXT:
+		// The box stores TXT values without quotes and quotes them
+		// itself when serving them, so values given as quoted strings,
+		// such as DKIM keys split into several, are unquoted and joined.
+		if text, ok := unquoteTXT(value); ok {
+			return text
+		}
+	case miab.MX, miab.SRV:
+		// The target is the last field, after preference and the
+		// SRV weight and port.
+		fields := strings.Fields(value)
+		if len(fields) > 1 {
+			fields[len(fields)-1] = normalizeTarget(fields[len(fields)-1])
+			return strings.Join(fields, " ")
+		}
+	}
+	return value
+}
+
+// unquoteTXT returns the text of a TXT value written as one or more quoted
+// character-strings, such as `"v=DKIM1; k=rsa; " "p=MIGf..."`, with the
+// strings joined and backslash escapes resolved. It reports false when the
+// value is not made of quoted strings only.
+func unquoteTXT(value string) (string, bool) {
+	if !strings.HasPrefix(value, `"`) {
+		return "", false
+	}
+	var text strings.Builder
+	for value != "" {
+		if value[0] != '"' {
+			return "", false
+		}
+		i := 1
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			text.WriteByte(value[i])
+		}
+		if i == len(value) {
+			return "", false
+		}
+		value = strings.TrimLeft(value[i+1:], " \t")
+	}
+	return text.String(), true
+}
+
+// normalizeTarget lowercases a host name and makes it fully qualified.
+func normalizeTarget(host string) string {
+	host = strings.ToLower(host)
+	if host != "" && !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	return host
 }
 
 // Interface guards
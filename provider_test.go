@@ -0,0 +1,1116 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+func TestEndToEnd(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	ctx := context.Background()
+
+	records, err := p.GetRecords(ctx, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("got %v, want no records", records)
+	}
+
+	added, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "TXT", Name: "@", Value: "hello"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 {
+		t.Fatalf("added %v, want 2 records", added)
+	}
+
+	records, err = p.GetRecords(ctx, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Name+" "+r.Type+" "+r.Value)
+	}
+	if want := []string{" TXT hello", "www A 192.0.2.1"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := p.DeleteRecords(ctx, "example.com.", records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := box.stored(), []string{"www.example.com A 192.0.2.1"}; !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+}
+
+func TestDefaultZone(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	p := box.provider()
+
+	if _, err := p.GetRecords(context.Background(), ""); err == nil {
+		t.Fatal("GetRecords with no zone and no DefaultZone succeeded")
+	}
+	p.DefaultZone = "example.com."
+	records, err := p.GetRecords(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Name != "www" {
+		t.Fatalf("got %v, want the www record", records)
+	}
+}
+
+func TestAppendRecordsValidatesBatchFirst(t *testing.T) {
+	tests := map[string][]libdns.Record{
+		"invalid value": {
+			{Type: "A", Name: "a", Value: "192.0.2.1"},
+			{Type: "A", Name: "b", Value: "not-an-address"},
+		},
+		"CNAME conflict within the batch": {
+			{Type: "A", Name: "a", Value: "192.0.2.1"},
+			{Type: "CNAME", Name: "a", Value: "target.example.com."},
+		},
+		"unsupported type": {
+			{Type: "A", Name: "a", Value: "192.0.2.1"},
+			{Type: "OPENPGPKEY", Name: "a", Value: "AAAA"},
+		},
+	}
+	for name, records := range tests {
+		t.Run(name, func(t *testing.T) {
+			box := newMockBox(t, "example.com")
+			if _, err := box.provider().AppendRecords(context.Background(), "example.com", records); err == nil {
+				t.Fatal("AppendRecords succeeded")
+			}
+			if w := box.writes(); len(w) != 0 {
+				t.Fatalf("made writes %q before failing", w)
+			}
+		})
+	}
+}
+
+func TestAppendRecordsEmpty(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	if _, err := p.AppendRecords(context.Background(), "example.com", nil); !errors.Is(err, ErrNoRecords) {
+		t.Fatalf("got %v, want ErrNoRecords", err)
+	}
+	p.AllowEmptyAppend = true
+	if _, err := p.AppendRecords(context.Background(), "example.com", nil); err != nil {
+		t.Fatalf("got %v with AllowEmptyAppend", err)
+	}
+}
+
+func TestSetRecordsAddsBeforeDeleting(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	_, err := box.provider().SetRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST www.example.com/A 192.0.2.2",
+		"DELETE www.example.com/A 192.0.2.1",
+	}
+	if got := box.writes(); !slices.Equal(got, want) {
+		t.Fatalf("writes %q, want %q", got, want)
+	}
+}
+
+func TestSetRecordsGroupsByQualifiedName(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.2")
+	_, err := box.provider().SetRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+		{Type: "a", Name: "WWW.example.com.", Value: "192.0.2.3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"www.example.com A 192.0.2.2", "www.example.com A 192.0.2.3"}
+	if got := box.stored(); !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+}
+
+func TestSetRecordsInvalidRecordWritesNothing(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	_, err := box.provider().SetRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "a", Value: "192.0.2.1"},
+		{Type: "AAAA", Name: "b", Value: "192.0.2.2"},
+	})
+	if err == nil {
+		t.Fatal("SetRecords succeeded")
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q before failing", w)
+	}
+}
+
+func TestSetRecordsReadBackIsNoop(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"alias.example.com CNAME Target.Example.com",
+		"example.com MX 10 mail.example.com.",
+	)
+	p := box.provider()
+	records, err := p.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SetRecords(context.Background(), "example.com", records); err != nil {
+		t.Fatal(err)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("setting records read back made writes %q", w)
+	}
+}
+
+func TestSetRecordsConcurrent(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	p := box.provider()
+	values := [][]string{
+		{"192.0.2.10", "192.0.2.11"},
+		{"192.0.2.20", "192.0.2.21"},
+	}
+	var wg sync.WaitGroup
+	for i, vs := range values {
+		// Each goroutine uses its own copy of the Provider, which must
+		// still share the zone lock.
+		q := *p
+		var records []libdns.Record
+		for _, v := range vs {
+			records = append(records, libdns.Record{Type: "A", Name: "www", Value: v})
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := q.SetRecords(context.Background(), "example.com", records); err != nil {
+				t.Errorf("SetRecords %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got := box.stored()
+	for _, vs := range values {
+		want := []string{"www.example.com A " + vs[0], "www.example.com A " + vs[1]}
+		if slices.Equal(got, want) {
+			return
+		}
+	}
+	t.Fatalf("stored %q, want the values of one of the calls", got)
+}
+
+func TestLockZoneHonorsContext(t *testing.T) {
+	p := &Provider{APIURL: "https://box.example.com/admin/dns/custom"}
+	unlock, err := p.lockZone(context.Background(), "lock.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.lockZone(ctx, "lock.example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+}
+
+func TestDeleteRecordsGroupsCalls(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"www.example.com A 192.0.2.2",
+		"www.example.com A 192.0.2.3",
+	)
+	p := box.provider()
+	records, err := p.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.DeleteRecords(context.Background(), "example.com", records); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := box.writes(), []string{"DELETE www.example.com/A"}; !slices.Equal(got, want) {
+		t.Fatalf("writes %q, want %q", got, want)
+	}
+	if got := box.stored(); len(got) != 0 {
+		t.Fatalf("stored %q, want nothing", got)
+	}
+}
+
+func TestDeleteRecordsSingleRecordOneCall(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("_acme-challenge.example.com TXT token")
+	_, err := box.provider().DeleteRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge", Value: "token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := box.count("GET"); n != 0 {
+		t.Fatalf("made %d record lookups, want none", n)
+	}
+	if got, want := box.writes(), []string{"DELETE _acme-challenge.example.com/TXT token"}; !slices.Equal(got, want) {
+		t.Fatalf("writes %q, want %q", got, want)
+	}
+}
+
+func TestDeleteRecordsProtectsApex(t *testing.T) {
+	records := []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "NS", Name: "@", Value: "ns.example.net."},
+	}
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1", "example.com NS ns.example.net.", "sub.example.com NS ns.example.net.")
+	p := box.provider()
+	_, err := p.DeleteRecords(context.Background(), "example.com", records)
+	if !errors.Is(err, ErrProtectedRecord) {
+		t.Fatalf("got %v, want ErrProtectedRecord", err)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q before failing", w)
+	}
+
+	// NS records below the apex are delegations, which can be deleted.
+	if _, err := p.DeleteRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "NS", Name: "sub", Value: "ns.example.net."},
+	}); err != nil {
+		t.Fatalf("deleting a delegation: %v", err)
+	}
+
+	p.AllowApexDeletion = true
+	deleted, err := p.DeleteRecords(context.Background(), "example.com", records)
+	if err != nil {
+		t.Fatalf("got %v with AllowApexDeletion", err)
+	}
+	if len(deleted) != 2 {
+		t.Fatalf("deleted %v, want both records", deleted)
+	}
+	if got := box.stored(); len(got) != 0 {
+		t.Fatalf("stored %q, want nothing", got)
+	}
+}
+
+func TestCallBudget(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	records := []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	added, err := p.AppendRecords(ctx, "example.com", records)
+	if !errors.Is(err, context.DeadlineExceeded) || len(added) != 0 {
+		t.Fatalf("got %v, %v; want no records and DeadlineExceeded", added, err)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q with too little time left", w)
+	}
+
+	p.MinCallBudget = 10 * time.Millisecond
+	if _, err := p.AppendRecords(ctx, "example.com", records); err != nil {
+		t.Fatalf("got %v with a smaller MinCallBudget", err)
+	}
+}
+
+func TestDeleteRecordsReturnsPartialResult(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("a.example.com A 192.0.2.1", "b.example.com A 192.0.2.2")
+	p := box.provider()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel the context once the first delete is done.
+	p.Tracer = tracerFunc(func(name string, _ map[string]string) func(map[string]string, error) {
+		return func(map[string]string, error) {
+			if name == "mailinabox.DeleteHost" {
+				cancel()
+			}
+		}
+	})
+	records := []libdns.Record{
+		{Type: "A", Name: "a", Value: "192.0.2.1"},
+		{Type: "A", Name: "b", Value: "192.0.2.2"},
+	}
+	deleted, err := p.DeleteRecords(ctx, "example.com", records)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if len(deleted) != 1 || deleted[0].Name != "a" {
+		t.Fatalf("deleted %v, want the first record", deleted)
+	}
+}
+
+// tracerFunc is a Tracer calling a function for every span.
+type tracerFunc func(name string, attrs map[string]string) func(map[string]string, error)
+
+func (f tracerFunc) StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(map[string]string, error)) {
+	return ctx, f(name, attrs)
+}
+
+func TestTracerSpans(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	p := box.provider()
+	var mu sync.Mutex
+	var spans []map[string]string
+	p.Tracer = tracerFunc(func(name string, attrs map[string]string) func(map[string]string, error) {
+		return func(end map[string]string, _ error) {
+			span := map[string]string{"name": name}
+			for k, v := range attrs {
+				span[k] = v
+			}
+			for k, v := range end {
+				span[k] = v
+			}
+			mu.Lock()
+			spans = append(spans, span)
+			mu.Unlock()
+		}
+	})
+	_, err := p.SetRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, span := range spans {
+		names = append(names, span["name"])
+		if span["dns.zone"] != "example.com" {
+			t.Errorf("span %s has zone %q", span["name"], span["dns.zone"])
+		}
+		if span["dns.status"] != "ok" {
+			t.Errorf("span %s has status %q", span["name"], span["dns.status"])
+		}
+	}
+	want := []string{
+		"mailinabox.GET zones",
+		"mailinabox.GetHosts",
+		"mailinabox.AddHost",
+		"mailinabox.DeleteHost",
+		"mailinabox.GetHosts",
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("spans %q, want %q", names, want)
+	}
+}
+
+func TestSupportedRecordTypes(t *testing.T) {
+	supported := SupportedRecordTypes()
+	for _, rtype := range supported {
+		if err := checkType(libdns.Record{Type: rtype}); err != nil {
+			t.Errorf("supported type %s is refused: %v", rtype, err)
+		}
+	}
+	// checkValue rejects an empty value for every type it validates, so
+	// this finds the types it handles among all the common ones.
+	candidates := []string{
+		"A", "AAAA", "AFSDB", "CAA", "CDNSKEY", "CDS", "CERT", "CNAME", "DNAME", "DNSKEY",
+		"DS", "HINFO", "HTTPS", "LOC", "MX", "NAPTR", "NS", "OPENPGPKEY", "PTR", "SMIMEA",
+		"SOA", "SPF", "SRV", "SSHFP", "SVCB", "TLSA", "TXT", "URI",
+	}
+	for _, rtype := range candidates {
+		if checkValue("example.com", libdns.Record{Type: rtype}) != nil && !slices.Contains(supported, rtype) {
+			t.Errorf("%s values are validated but %s is not in SupportedRecordTypes", rtype, rtype)
+		}
+	}
+}
+
+func TestPruneAcmeChallenges(t *testing.T) {
+	box := newMockBox(t, "example.com", "example.org")
+	box.add(
+		"_acme-challenge.example.com TXT token1",
+		"_acme-challenge.www.example.com TXT token2",
+		"_acme-challenge.example.com CNAME acme.example.net.",
+		"_acme-challenge.example.org TXT token3",
+		"www.example.com TXT _acme-challenge",
+		"x_acme-challenge.example.com TXT kept",
+	)
+	removed, err := box.provider().PruneAcmeChallenges(context.Background(), "example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("removed %d records, want 2", removed)
+	}
+	want := []string{
+		"_acme-challenge.example.com CNAME acme.example.net.",
+		"_acme-challenge.example.org TXT token3",
+		"www.example.com TXT _acme-challenge",
+		"x_acme-challenge.example.com TXT kept",
+	}
+	if got := box.stored(); !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+}
+
+func TestZoneTrailingDot(t *testing.T) {
+	// run goes through the four libdns methods with the zone spelled as
+	// given and returns what they returned and what the box saw.
+	run := func(t *testing.T, zone string) []string {
+		box := newMockBox(t, "example.com")
+		box.add("old.example.com A 192.0.2.9")
+		p := box.provider()
+		ctx := context.Background()
+		var out []string
+		log := func(op string, records []libdns.Record, err error) {
+			if err != nil {
+				t.Fatalf("%s: %v", op, err)
+			}
+			for _, r := range records {
+				out = append(out, op+" "+r.Name+" "+r.Type+" "+r.Value)
+			}
+		}
+		records, err := p.AppendRecords(ctx, zone, []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1"}})
+		log("append", records, err)
+		records, err = p.SetRecords(ctx, zone, []libdns.Record{{Type: "TXT", Name: "@", Value: "hello"}})
+		log("set", records, err)
+		records, err = p.GetRecords(ctx, zone)
+		log("get", records, err)
+		records, err = p.DeleteRecords(ctx, zone, []libdns.Record{{Type: "A", Name: "old", Value: "192.0.2.9"}})
+		log("delete", records, err)
+		out = append(out, box.writes()...)
+		return append(out, box.stored()...)
+	}
+	bare := run(t, "example.com")
+	dotted := run(t, "example.com.")
+	if !slices.Equal(bare, dotted) {
+		t.Fatalf("with a trailing dot got\n%q\nwithout\n%q", dotted, bare)
+	}
+}
+
+func TestGetRecordsSkipsEmptyValues(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"empty.example.com A ",
+		"blank.example.com A    ",
+		"www.example.com A 192.0.2.1",
+	)
+	records, err := box.provider().GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Name != "www" {
+		t.Fatalf("got %v, want only the record with a value", records)
+	}
+}
+
+// rotatingCredentials is a CredentialProvider whose password can be changed.
+type rotatingCredentials struct {
+	mu       sync.Mutex
+	password string
+}
+
+func (c *rotatingCredentials) Credentials(ctx context.Context) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return mockEmail, c.password, nil
+}
+
+func (c *rotatingCredentials) rotate(password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.password = password
+}
+
+func TestCredentialProviderRotation(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	creds := &rotatingCredentials{password: mockPassword}
+	p := &Provider{APIURL: box.provider().APIURL, CredentialProvider: creds}
+	if _, err := p.GetRecords(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	box.setPassword(mockEmail, "rotated")
+	if _, err := p.GetRecords(context.Background(), "example.com"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v with the old password, want ErrAuthFailed", err)
+	}
+	creds.rotate("rotated")
+	if _, err := p.GetRecords(context.Background(), "example.com"); err != nil {
+		t.Fatalf("rotated password not picked up: %v", err)
+	}
+}
+
+func TestWithCredentials(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.setPassword("other@example.com", "other-secret")
+	p := box.provider()
+
+	ctx := WithCredentials(context.Background(), "other@example.com", "other-secret")
+	if _, err := p.GetRecords(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range box.loggedIn() {
+		if email != "other@example.com" {
+			t.Fatalf("logged in as %q, want only the override account", email)
+		}
+	}
+
+	n := len(box.loggedIn())
+	if _, err := p.GetRecords(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range box.loggedIn()[n:] {
+		if email != mockEmail {
+			t.Fatalf("logged in as %q without the override, want %q", email, mockEmail)
+		}
+	}
+
+	ctx = WithCredentials(context.Background(), "other@example.com", "wrong")
+	if _, err := p.GetRecords(ctx, "example.com"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v with a wrong override password, want ErrAuthFailed", err)
+	}
+}
+
+func TestRecordExists(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"alias.example.com CNAME target.example.com.",
+	)
+	p := box.provider()
+	tests := []struct {
+		name, rtype, value string
+		want               bool
+	}{
+		{"www", "A", "192.0.2.1", true},
+		{"www", "a", "", true},
+		{"www", "A", "192.0.2.2", false},
+		{"www", "AAAA", "", false},
+		{"missing", "A", "", false},
+		{"alias", "CNAME", "Target.Example.com", true},
+		{"alias.example.com.", "CNAME", "target.example.com.", true},
+	}
+	for _, tt := range tests {
+		got, err := p.RecordExists(context.Background(), "example.com", tt.name, tt.rtype, tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("RecordExists(%q, %q, %q) = %t, want %t", tt.name, tt.rtype, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAppendRecordsCNAMEConflict(t *testing.T) {
+	tests := map[string]struct {
+		stored string
+		record libdns.Record
+		ok     bool
+	}{
+		"A next to a stored CNAME": {
+			stored: "www.example.com CNAME target.example.com.",
+			record: libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"},
+		},
+		"CNAME next to a stored A": {
+			stored: "www.example.com A 192.0.2.1",
+			record: libdns.Record{Type: "CNAME", Name: "www", Value: "target.example.com."},
+		},
+		"second CNAME value": {
+			stored: "www.example.com CNAME target.example.com.",
+			record: libdns.Record{Type: "CNAME", Name: "www", Value: "other.example.com."},
+		},
+		"same CNAME again": {
+			stored: "www.example.com CNAME target.example.com.",
+			record: libdns.Record{Type: "CNAME", Name: "www", Value: "Target.Example.com"},
+			ok:     true,
+		},
+		"A next to a CNAME at another name": {
+			stored: "alias.example.com CNAME target.example.com.",
+			record: libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"},
+			ok:     true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			box := newMockBox(t, "example.com")
+			box.add(tt.stored)
+			_, err := box.provider().AppendRecords(context.Background(), "example.com", []libdns.Record{tt.record})
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var conflict *CNAMEConflictError
+			if !errors.As(err, &conflict) {
+				t.Fatalf("got %v, want a CNAMEConflictError", err)
+			}
+			if w := box.writes(); len(w) != 0 {
+				t.Fatalf("made writes %q", w)
+			}
+		})
+	}
+}
+
+func TestOnConvert(t *testing.T) {
+	box := newMockBox(t, "example.com", "example.org")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"empty.example.com A ",
+		"example.com TXT hello",
+		"example.com TXT hello",
+		"www.example.org A 192.0.2.2",
+	)
+	p := box.provider()
+	var converted, failed []string
+	p.OnConvert = func(raw miab.DNSRecord, r libdns.Record, err error) {
+		if err != nil {
+			failed = append(failed, raw.QualifiedName+" "+string(raw.RecordType))
+			return
+		}
+		converted = append(converted, r.Name+" "+r.Type)
+	}
+	if _, err := p.GetRecords(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"www A", " TXT"}; !slices.Equal(converted, want) {
+		t.Errorf("converted %q, want %q", converted, want)
+	}
+	if want := []string{"empty.example.com A", "example.com TXT"}; !slices.Equal(failed, want) {
+		t.Errorf("failed %q, want %q", failed, want)
+	}
+}
+
+func TestBoxRouting(t *testing.T) {
+	com := newMockBox(t, "example.com")
+	org := newMockBox(t, "example.org", "sub.example.org")
+	org.accounts = map[string]string{"dns@example.org": "org-secret"}
+	p := com.provider()
+	p.Boxes = map[string]BoxConfig{
+		"example.org.": {
+			APIURL:       org.provider().APIURL,
+			EmailAddress: "dns@example.org",
+			Password:     "org-secret",
+		},
+	}
+	ctx := context.Background()
+	for _, zone := range []string{"example.com", "example.org", "sub.example.org"} {
+		if _, err := p.AppendRecords(ctx, zone, []libdns.Record{{Type: "TXT", Name: "owner", Value: zone}}); err != nil {
+			t.Fatalf("%s: %v", zone, err)
+		}
+	}
+	if got, want := com.stored(), []string{"owner.example.com TXT example.com"}; !slices.Equal(got, want) {
+		t.Errorf("first box stored %q, want %q", got, want)
+	}
+	want := []string{"owner.example.org TXT example.org", "owner.sub.example.org TXT sub.example.org"}
+	if got := org.stored(); !slices.Equal(got, want) {
+		t.Errorf("second box stored %q, want %q", got, want)
+	}
+	zones, err := p.ListZones(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com.", "example.org.", "sub.example.org."}; !slices.Equal(zones, want) {
+		t.Errorf("ListZones = %q, want %q", zones, want)
+	}
+}
+
+func TestGetRecordsOrder(t *testing.T) {
+	stored := []string{
+		"www.example.com A 192.0.2.2",
+		"example.com TXT b",
+		"www.example.com AAAA 2001:db8::1",
+		"mail.example.com A 192.0.2.3",
+		"www.example.com A 192.0.2.1",
+		"example.com TXT a",
+	}
+	var results [][]string
+	for _, order := range [][]int{{0, 1, 2, 3, 4, 5}, {5, 4, 3, 2, 1, 0}, {2, 5, 0, 3, 1, 4}} {
+		box := newMockBox(t, "example.com")
+		for _, i := range order {
+			box.add(stored[i])
+		}
+		records, err := box.provider().GetRecords(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Name+" "+r.Type+" "+r.Value)
+		}
+		results = append(results, got)
+	}
+	want := []string{
+		" TXT a",
+		" TXT b",
+		"mail A 192.0.2.3",
+		"www A 192.0.2.1",
+		"www A 192.0.2.2",
+		"www AAAA 2001:db8::1",
+	}
+	for _, got := range results {
+		if !slices.Equal(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMaxRecordsPerZone(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.example.com A 192.0.2.1")
+	p := box.provider()
+	p.MaxRecordsPerZone = 2
+
+	// One record is stored and one is new, which reaches the limit.
+	_, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+	})
+	if err != nil {
+		t.Fatalf("append up to the limit: %v", err)
+	}
+
+	box.resetCalls()
+	_, err = p.AppendRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "A", Name: "www", Value: "192.0.2.3"},
+	})
+	var full *ZoneFullError
+	if !errors.As(err, &full) {
+		t.Fatalf("got %v, want a ZoneFullError", err)
+	}
+	if full.Count != 2 || full.Adding != 1 || full.Max != 2 {
+		t.Fatalf("got %+v, want 2 stored and 1 to add", full)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q past the limit", w)
+	}
+}
+
+func TestToMIABRecords(t *testing.T) {
+	records := []libdns.Record{
+		{Type: "A", Name: "www", Value: " 192.0.2.1 "},
+		{Type: "aaaa", Name: "www", Value: "2001:db8::1"},
+		{Type: "CNAME", Name: "alias", Value: "Target.Example.com"},
+		{Type: "NS", Name: "sub", Value: "NS1.example.net"},
+		{Type: "MX", Name: "@", Value: "10 Mail.example.com"},
+		{Type: "MX", Name: "@", Value: "mail2.example.com.", Priority: 20},
+		{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 SIP.example.com"},
+		{Type: "SRV", Name: "_xmpp._tcp", Value: "0 5222 xmpp.example.com", Priority: 5},
+		{Type: "TXT", Name: "@", Value: `"v=spf1 -all"`},
+		{Type: "CAA", Name: "@", Value: `0 issue "letsencrypt.org"`},
+		{Type: "SSHFP", Name: "www", Value: "1 2 0123456789abcdef"},
+	}
+	want := []string{
+		"www.example.com A 192.0.2.1",
+		"www.example.com AAAA 2001:db8::1",
+		"alias.example.com CNAME target.example.com.",
+		"sub.example.com NS ns1.example.net.",
+		"example.com MX 10 mail.example.com.",
+		"example.com MX 20 mail2.example.com.",
+		"_sip._tcp.example.com SRV 10 5 5060 sip.example.com.",
+		"_xmpp._tcp.example.com SRV 5 0 5222 xmpp.example.com.",
+		"example.com TXT v=spf1 -all",
+		`example.com CAA 0 issue "letsencrypt.org"`,
+		"www.example.com SSHFP 1 2 0123456789abcdef",
+	}
+	mrs, err := ToMIABRecords("Example.com.", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, mr := range mrs {
+		if mr.Zone != "example.com" {
+			t.Errorf("%s has zone %q", mr.QualifiedName, mr.Zone)
+		}
+		got = append(got, mr.QualifiedName+" "+string(mr.RecordType)+" "+mr.Value)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got\n%q\nwant\n%q", got, want)
+	}
+
+	if _, err := ToMIABRecords("example.com", []libdns.Record{{Type: "A", Name: "www", Value: "2001:db8::1"}}); err == nil {
+		t.Fatal("invalid record converted")
+	}
+}
+
+func TestRawClient(t *testing.T) {
+	com := newMockBox(t, "example.com")
+	com.add("www.example.com A 192.0.2.1")
+	org := newMockBox(t, "example.org")
+	org.add("www.example.org A 192.0.2.2")
+	ctx := context.Background()
+
+	creds := &rotatingCredentials{password: mockPassword}
+	p := &Provider{APIURL: com.provider().APIURL, CredentialProvider: creds}
+	client, err := p.RawClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == nil || client.ApiUrl.Host != com.server.Listener.Addr().String() || client.ApiUrl.User.Username() != mockEmail {
+		t.Fatalf("got client %+v, want one for %s as %s", client, p.APIURL, mockEmail)
+	}
+	if _, err := client.GetHosts(ctx, "", ""); err != nil {
+		t.Fatalf("client not authenticated with the CredentialProvider: %v", err)
+	}
+
+	p.DefaultZone = "example.org"
+	p.Boxes = map[string]BoxConfig{"example.org": {
+		APIURL:       org.provider().APIURL,
+		EmailAddress: mockEmail,
+		Password:     mockPassword,
+	}}
+	client, err = p.RawClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := client.GetHosts(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].QualifiedName != "www.example.org" {
+		t.Fatalf("got %v, want the records of the box routed to for DefaultZone", records)
+	}
+}
+
+func TestNormalizeTXT(t *testing.T) {
+	tests := map[string]string{
+		`hello`:                                  `hello`,
+		`"hello"`:                                `hello`,
+		`"v=DKIM1; k=rsa; " "p=ABC"`:             `v=DKIM1; k=rsa; p=ABC`,
+		`"v=DKIM1; k=rsa; "   "p=A" "BC"`:        `v=DKIM1; k=rsa; p=ABC`,
+		`"say \"hi\" \\ bye"`:                    `say "hi" \ bye`,
+		`say "hi"`:                               `say "hi"`,
+		`"unterminated`:                          `"unterminated`,
+		`"quoted" then not`:                      `"quoted" then not`,
+		`  "padded"  `:                           `padded`,
+		`"v=spf1 include:_spf.example.com -all"`: `v=spf1 include:_spf.example.com -all`,
+	}
+	for value, want := range tests {
+		if got := normalizeValue(miab.TXT, value); got != want {
+			t.Errorf("normalizeValue(TXT, %q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestDKIMRoundTrip(t *testing.T) {
+	const (
+		quoted   = `"v=DKIM1; k=rsa; " "p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQC"`
+		unquoted = `v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQC`
+		name     = "mail._domainkey"
+	)
+	var boxes []*mockBox
+	for _, value := range []string{quoted, unquoted} {
+		box := newMockBox(t, "example.com")
+		p := box.provider()
+		ctx := context.Background()
+		if _, err := p.AppendRecords(ctx, "example.com", []libdns.Record{{Type: "TXT", Name: name, Value: value}}); err != nil {
+			t.Fatal(err)
+		}
+		records, err := p.GetRecords(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Value != unquoted {
+			t.Fatalf("%s: read back %v, want %q", value, records, unquoted)
+		}
+		// Setting either spelling again changes nothing.
+		box.resetCalls()
+		for _, again := range []string{quoted, unquoted} {
+			if _, err := p.SetRecords(ctx, "example.com", []libdns.Record{{Type: "TXT", Name: name, Value: again}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if w := box.writes(); len(w) != 0 {
+			t.Fatalf("%s: setting the value again made writes %q", value, w)
+		}
+		boxes = append(boxes, box)
+	}
+	if a, b := boxes[0].stored(), boxes[1].stored(); !slices.Equal(a, b) {
+		t.Fatalf("quoted value stored as %q, unquoted as %q", a, b)
+	}
+
+	box := boxes[0]
+	if _, err := box.provider().DeleteRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "TXT", Name: name, Value: quoted},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := box.stored(); len(got) != 0 {
+		t.Fatalf("deleting the quoted value left %q", got)
+	}
+}
+
+func TestGetRecordsDuplicates(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"www.example.com A 192.0.2.1",
+		"WWW.example.com. A 192.0.2.1",
+		"www.example.com A 192.0.2.2",
+		"alias.example.com CNAME target.example.com",
+		"alias.example.com CNAME Target.example.com.",
+	)
+	records, err := box.provider().GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Name+" "+r.Type+" "+r.Value)
+	}
+	want := []string{"alias CNAME target.example.com.", "www A 192.0.2.1", "www A 192.0.2.2"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetRecordsReturnsStoredRecords(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	// Like the box, store IPv6 addresses in their canonical form.
+	box.normalize = func(rtype, value string) string {
+		if ip, err := netip.ParseAddr(value); err == nil && rtype == "AAAA" {
+			return ip.String()
+		}
+		return value
+	}
+	box.add("other.example.com A 192.0.2.9")
+	records, err := box.provider().SetRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "AAAA", Name: "www", Value: "2001:DB8:0:0::1"},
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Name+" "+r.Type+" "+r.Value)
+	}
+	slices.Sort(got)
+	if want := []string{"www A 192.0.2.1", "www AAAA 2001:db8::1"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want the records as the box stored them, %q", got, want)
+	}
+}
+
+func TestUnderscoreLabelsRoundTrip(t *testing.T) {
+	records := []libdns.Record{
+		{Type: "TXT", Name: "_dmarc", Value: "v=DMARC1; p=reject; rua=mailto:dmarc@example.com"},
+		{Type: "TXT", Name: "_dmarc.sub", Value: "v=DMARC1; p=none"},
+		{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com."},
+	}
+	for _, validate := range []bool{false, true} {
+		box := newMockBox(t, "example.com")
+		p := box.provider()
+		p.ValidateNames = validate
+		if _, err := p.AppendRecords(context.Background(), "example.com", records); err != nil {
+			t.Fatalf("ValidateNames %t: %v", validate, err)
+		}
+		want := []string{
+			"_dmarc.example.com TXT v=DMARC1; p=reject; rua=mailto:dmarc@example.com",
+			"_dmarc.sub.example.com TXT v=DMARC1; p=none",
+			"_sip._tcp.example.com SRV 10 5 5060 sip.example.com.",
+		}
+		if got := box.stored(); !slices.Equal(got, want) {
+			t.Fatalf("ValidateNames %t: stored %q, want %q", validate, got, want)
+		}
+		got, err := p.GetRecords(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, r := range got {
+			if w := records[i]; r.Name != w.Name || r.Type != w.Type || r.Value != w.Value {
+				t.Errorf("ValidateNames %t: read back %+v, want %+v", validate, r, w)
+			}
+		}
+		if got[2].Priority != 10 {
+			t.Errorf("SRV priority read back as %d, want 10", got[2].Priority)
+		}
+	}
+}
+
+func TestWriteErrorNamesRecord(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	// gomiabdns refuses to add a record without a value.
+	err := p.AppendRawRecords(context.Background(), "example.com", []miab.DNSRecord{
+		{QualifiedName: "www.example.com", RecordType: miab.TXT},
+	})
+	if err == nil {
+		t.Fatal("adding a record without a value succeeded")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "adding TXT record www.example.com") {
+		t.Fatalf("error %q does not name the record and type", msg)
+	}
+
+	secret := miab.DNSRecord{QualifiedName: "api.example.com", RecordType: miab.TXT, Value: "token=hunter2"}
+	err = writeError("deleting", secret, errors.New("connection reset"))
+	if msg := err.Error(); !strings.Contains(msg, "deleting TXT record api.example.com") || strings.Contains(msg, "hunter2") {
+		t.Fatalf("error %q should name the record and type but not the value", msg)
+	}
+}
+
+func TestErrorOnUnknownType(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"host.example.com HINFO \"PC\" \"Linux\"",
+	)
+	p := box.provider()
+	records, err := p.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Type != "HINFO" {
+		t.Fatalf("got %v, want the HINFO record passed through", records)
+	}
+
+	p.ErrorOnUnknownType = true
+	_, err = p.GetRecords(context.Background(), "example.com")
+	if !errors.Is(err, ErrUnsupportedRecordType) || !strings.Contains(err.Error(), "host.example.com") {
+		t.Fatalf("got %v, want ErrUnsupportedRecordType naming the record", err)
+	}
+}
+
+func TestBoxQualifiedName(t *testing.T) {
+	for _, qname := range []string{"www.example.com", "www.example.com.", "WWW.Example.COM.", "www"} {
+		mr := miab.DNSRecord{QualifiedName: qname, Zone: "example.com", RecordType: miab.A, Value: "192.0.2.1"}
+		if got := boxQualifiedName(mr); got != "www.example.com" {
+			t.Errorf("%q: got %q, want www.example.com", qname, got)
+		}
+	}
+	for _, qname := range []string{"example.com", "example.com.", "@", ""} {
+		mr := miab.DNSRecord{QualifiedName: qname, Zone: "example.com.", RecordType: miab.TXT, Value: "apex"}
+		if got := boxQualifiedName(mr); got != "example.com" {
+			t.Errorf("%q: got %q, want example.com", qname, got)
+		}
+	}
+
+	box := newMockBox(t, "example.com")
+	box.records = append(box.records,
+		mockRecord{QName: "www.example.com", RType: "A", Value: "192.0.2.1", Zone: "example.com"},
+		mockRecord{QName: "www.example.com.", RType: "A", Value: "192.0.2.2", Zone: "example.com"},
+		mockRecord{QName: "www", RType: "A", Value: "192.0.2.3", Zone: "example.com"},
+	)
+	records, err := box.provider().GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %v, want three records", records)
+	}
+	for _, r := range records {
+		if r.Name != "www" {
+			t.Errorf("got name %q for %s, want www", r.Name, r.Value)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// ErrMultipleRecords is returned by GetRecord when more than one record has
+// the given name and type.
+var ErrMultipleRecords = errors.New("more than one record matches")
+
+// ZoneRecordTypes returns the distinct record types present in the zone,
+// sorted alphabetically.
+func (p *Provider) ZoneRecordTypes(ctx context.Context, zone string) ([]string, error) {
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	types := []string{}
+	for _, r := range records {
+		if !seen[r.Type] {
+			seen[r.Type] = true
+			types = append(types, r.Type)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// GetRRSets returns the records in the zone grouped into record sets, keyed
+// by "name|type".
+func (p *Provider) GetRRSets(ctx context.Context, zone string) (map[string][]libdns.Record, error) {
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	rrsets := make(map[string][]libdns.Record)
+	for _, r := range records {
+		key := r.Name + "|" + r.Type
+		rrsets[key] = append(rrsets[key], r)
+	}
+	return rrsets, nil
+}
+
+// RecordsIter returns an iterator over the records in the zone, which can
+// be ranged over with Go 1.23 or later. Records are yielded as they are
+// converted, in the order the box lists them, so callers need not hold the
+// whole zone at once. An error ends the iteration.
+func (p *Provider) RecordsIter(ctx context.Context, zone string) func(yield func(libdns.Record, error) bool) {
+	return func(yield func(libdns.Record, error) bool) {
+		zone := p.zoneOrDefault(zone)
+		if _, err := p.zoneCheck(ctx, zone); err != nil {
+			yield(libdns.Record{}, err)
+			return
+		}
+		client, err := p.getClient(ctx, zone)
+		if err != nil {
+			yield(libdns.Record{}, err)
+			return
+		}
+		miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+		if err != nil {
+			yield(libdns.Record{}, err)
+			return
+		}
+		err = p.convertRecords(zone, miabRecords, func(r libdns.Record) bool {
+			return yield(r, nil)
+		})
+		if err != nil {
+			yield(libdns.Record{}, err)
+		}
+	}
+}
+
+// GetRecordsUnder returns the records in the zone at subdomain or below it.
+// The subdomain is relative to the zone, like record names, or fully
+// qualified with a trailing dot.
+func (p *Provider) GetRecordsUnder(ctx context.Context, zone, subdomain string) ([]libdns.Record, error) {
+	zone = p.zoneOrDefault(zone)
+	sub, err := qualifiedName(subdomain, zone)
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	under := []libdns.Record{}
+	for _, r := range records {
+		name, err := qualifiedName(r.Name, zone)
+		if err != nil {
+			continue
+		}
+		if inZone(name, sub) {
+			under = append(under, r)
+		}
+	}
+	return under, nil
+}
+
+// GetRecord returns the record with the given name and type. The boolean is
+// false when there is no such record. Only the records of that name are
+// fetched from the box. If the name and type hold several values,
+// ErrMultipleRecords is returned; use GetRecords for record sets.
+func (p *Provider) GetRecord(ctx context.Context, zone, name, recordType string) (libdns.Record, bool, error) {
+	zone = p.zoneOrDefault(zone)
+	if _, err := p.zoneCheck(ctx, zone); err != nil {
+		return libdns.Record{}, false, err
+	}
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return libdns.Record{}, false, err
+	}
+	rtype := miab.RecordType(strings.ToUpper(recordType))
+	qname, err := qualifiedName(name, zone)
+	if err != nil {
+		return libdns.Record{}, false, err
+	}
+	miabRecords, err := p.getHosts(ctx, client, zone, qname, rtype)
+	if err != nil {
+		return libdns.Record{}, false, err
+	}
+	var matches []miab.DNSRecord
+	for _, mr := range miabRecords {
+		if mr.QualifiedName == qname && mr.RecordType == rtype {
+			matches = append(matches, mr)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return libdns.Record{}, false, nil
+	case 1:
+		r, err := toLibDnsRecord(zone, matches[0])
+		return r, err == nil, err
+	}
+	return libdns.Record{}, false, fmt.Errorf("%w: %d %s records at %s", ErrMultipleRecords, len(matches), rtype, qname)
+}
+
+// RecordWithFQDN is a record together with its fully qualified name.
+type RecordWithFQDN struct {
+	Record libdns.Record
+	// FQDN is the record's name with the zone appended and a trailing dot.
+	FQDN string
+}
+
+// GetRecordsWithFQDN returns the records in the zone like GetRecords, each
+// alongside its fully qualified name.
+func (p *Provider) GetRecordsWithFQDN(ctx context.Context, zone string) ([]RecordWithFQDN, error) {
+	zone = p.zoneOrDefault(zone)
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	withFQDN := make([]RecordWithFQDN, 0, len(records))
+	for _, r := range records {
+		name, err := qualifiedName(r.Name, zone)
+		if err != nil {
+			return nil, err
+		}
+		withFQDN = append(withFQDN, RecordWithFQDN{Record: r, FQDN: name + "."})
+	}
+	return withFQDN, nil
+}
+
+// maxConcurrentZones bounds how many zones GetAllRecords reads at once.
+const maxConcurrentZones = 4
+
+// GetAllRecords returns the records of every zone ListZones reports, keyed
+// by the fully qualified zone name. Zones are read concurrently, a few at
+// a time. A zone that cannot be read is left out of the result and its
+// error is joined into the returned error, so the other zones are still
+// returned.
+func (p *Provider) GetAllRecords(ctx context.Context) (map[string][]libdns.Record, error) {
+	zones, err := p.ListZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	all := make(map[string][]libdns.Record, len(zones))
+	sem := make(chan struct{}, maxConcurrentZones)
+	for _, zone := range zones {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			records, err := p.GetRecords(ctx, zone)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", zone, err))
+				return
+			}
+			all[zone] = records
+		}(zone)
+	}
+	wg.Wait()
+	return all, errors.Join(errs...)
+}
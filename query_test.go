@@ -0,0 +1,202 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func TestZoneRecordTypes(t *testing.T) {
+	box := newMockBox(t, "example.com", "example.org")
+	box.add(
+		"www.example.com TXT b",
+		"www.example.com A 192.0.2.1",
+		"mail.example.com A 192.0.2.2",
+		"example.com MX 10 mail.example.com.",
+		"example.com TXT a",
+		"www.example.org AAAA 2001:db8::1",
+	)
+	types, err := box.provider().ZoneRecordTypes(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A", "MX", "TXT"}; !slices.Equal(types, want) {
+		t.Fatalf("got %q, want %q", types, want)
+	}
+
+	empty := newMockBox(t, "example.net")
+	types, err = empty.provider().ZoneRecordTypes(context.Background(), "example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types == nil || len(types) != 0 {
+		t.Fatalf("got %#v for an empty zone, want an empty list", types)
+	}
+}
+
+func TestGetRRSets(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.2",
+		"www.example.com A 192.0.2.1",
+		"www.example.com AAAA 2001:db8::1",
+		"mail.example.com A 192.0.2.3",
+		"www.example.com A 192.0.2.3",
+	)
+	rrsets, err := box.provider().GetRRSets(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for key, records := range rrsets {
+		for _, r := range records {
+			got[key] = append(got[key], r.Value)
+		}
+	}
+	want := map[string][]string{
+		"www|A":    {"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		"www|AAAA": {"2001:db8::1"},
+		"mail|A":   {"192.0.2.3"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for key, values := range want {
+		if !slices.Equal(got[key], values) {
+			t.Errorf("%s holds %q, want %q", key, got[key], values)
+		}
+	}
+}
+
+func TestRecordsIter(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"empty.example.com A ",
+		"example.com TXT hello",
+		"mail.example.com A 192.0.2.2",
+	)
+	p := box.provider()
+	var got []string
+	p.RecordsIter(context.Background(), "example.com")(func(r libdns.Record, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r.Name+" "+r.Type+" "+r.Value)
+		return true
+	})
+	// Records come in the order the box lists them.
+	if want := []string{"www A 192.0.2.1", " TXT hello", "mail A 192.0.2.2"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	n := 0
+	p.RecordsIter(context.Background(), "example.com")(func(r libdns.Record, err error) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("iterator went on after being stopped: %d records", n)
+	}
+
+	var errs []error
+	p.RecordsIter(context.Background(), "example.org")(func(r libdns.Record, err error) bool {
+		errs = append(errs, err)
+		return true
+	})
+	if len(errs) != 1 || errs[0] == nil {
+		t.Fatalf("got %v for a zone not on the box, want one error", errs)
+	}
+}
+
+func TestGetRecordsUnder(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"dev.example.com A 192.0.2.1",
+		"api.dev.example.com A 192.0.2.2",
+		"v1.api.dev.example.com A 192.0.2.3",
+		"xdev.example.com A 192.0.2.4",
+		"dev.other.example.com A 192.0.2.5",
+		"example.com A 192.0.2.6",
+	)
+	p := box.provider()
+	want := []string{"api.dev", "dev", "v1.api.dev"}
+	for _, sub := range []string{"dev", "dev.example.com.", "DEV"} {
+		records, err := p.GetRecordsUnder(context.Background(), "example.com", sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("under %q got %q, want %q", sub, got, want)
+		}
+	}
+	if _, err := p.GetRecordsUnder(context.Background(), "example.com", "dev.example.org."); !errors.Is(err, ErrNameOutsideZone) {
+		t.Errorf("got %v for a subdomain outside the zone, want ErrNameOutsideZone", err)
+	}
+}
+
+func TestGetRecord(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"www.example.com TXT hello",
+		"multi.example.com A 192.0.2.2",
+		"multi.example.com A 192.0.2.3",
+	)
+	p := box.provider()
+
+	r, ok, err := p.GetRecord(context.Background(), "example.com", "www", "a")
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v, want the record", ok, err)
+	}
+	if r.Name != "www" || r.Type != "A" || r.Value != "192.0.2.1" {
+		t.Fatalf("got %+v, want www A 192.0.2.1", r)
+	}
+
+	_, ok, err = p.GetRecord(context.Background(), "example.com", "missing", "A")
+	if err != nil || ok {
+		t.Fatalf("got %v, %v for a missing record, want false and no error", ok, err)
+	}
+
+	_, ok, err = p.GetRecord(context.Background(), "example.com", "multi", "A")
+	if !errors.Is(err, ErrMultipleRecords) || ok {
+		t.Fatalf("got %v, %v for two values, want ErrMultipleRecords", ok, err)
+	}
+}
+
+func TestGetRecordsWithFQDN(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"example.com TXT apex",
+		"www.example.com A 192.0.2.1",
+		"a.b.example.com A 192.0.2.2",
+	)
+	records, err := box.provider().GetRecordsWithFQDN(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, r := range records {
+		got[r.Record.Name] = r.FQDN
+	}
+	want := map[string]string{
+		"":    "example.com.",
+		"www": "www.example.com.",
+		"a.b": "a.b.example.com.",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for name, fqdn := range want {
+		if got[name] != fqdn {
+			t.Errorf("%q has FQDN %q, want %q", name, got[name], fqdn)
+		}
+	}
+}
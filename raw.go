@@ -0,0 +1,67 @@
+package mailinabox
+
+import (
+	"context"
+	"fmt"
+
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// GetRawRecords returns the records of the zone as the box lists them,
+// without converting them. Only qualified names are lowercased, as they are
+// for every read.
+func (p *Provider) GetRawRecords(ctx context.Context, zone string) ([]miab.DNSRecord, error) {
+	zone = p.zoneOrDefault(zone)
+	if _, err := p.zoneCheck(ctx, zone); err != nil {
+		return nil, err
+	}
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	miabRecords, err := p.getHosts(ctx, client, zone, "", "")
+	if err != nil {
+		return nil, err
+	}
+	raw := []miab.DNSRecord{}
+	for _, mr := range miabRecords {
+		if inZone(mr.QualifiedName, zone) {
+			raw = append(raw, mr)
+		}
+	}
+	return raw, nil
+}
+
+// AppendRawRecords adds records to the zone exactly as given, skipping the
+// validation and normalization other writes get. Only their qualified
+// names are checked to belong to the zone.
+func (p *Provider) AppendRawRecords(ctx context.Context, zone string, raw []miab.DNSRecord) error {
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return err
+	}
+	unlock, err := p.lockZone(ctx, controlled)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, mr := range raw {
+		if !inZone(mr.QualifiedName, zone) {
+			return fmt.Errorf("%w: %s is not in %s", ErrNameOutsideZone, mr.QualifiedName, zone)
+		}
+	}
+	client, err := p.getClient(ctx, zone)
+	if err != nil {
+		return err
+	}
+	for _, mr := range raw {
+		if err := p.checkBudget(ctx); err != nil {
+			return err
+		}
+		if err := p.addHost(ctx, client, zone, mr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
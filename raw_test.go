@@ -0,0 +1,59 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	miab "github.com/luv2code/gomiabdns"
+)
+
+func TestGetRawRecords(t *testing.T) {
+	box := newMockBox(t, "example.com", "example.org")
+	box.add(
+		"www.example.com CNAME Target.Example.com",
+		"example.com TXT \"quoted\"",
+		"www.example.org A 192.0.2.1",
+	)
+	raw, err := box.provider().GetRawRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, mr := range raw {
+		got = append(got, mr.QualifiedName+" "+string(mr.RecordType)+" "+mr.Value)
+	}
+	want := []string{"www.example.com CNAME Target.Example.com", `example.com TXT "quoted"`}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want the values of the zone as stored, %q", got, want)
+	}
+}
+
+func TestAppendRawRecords(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	err := p.AppendRawRecords(context.Background(), "example.com", []miab.DNSRecord{
+		{QualifiedName: "www.example.com", RecordType: miab.CNAME, Value: "Target.Example.com"},
+		{QualifiedName: "example.com", RecordType: miab.TXT, Value: `"quoted"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`example.com TXT "quoted"`, "www.example.com CNAME Target.Example.com"}
+	if got := box.stored(); !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want the values verbatim, %q", got, want)
+	}
+
+	box.resetCalls()
+	err = p.AppendRawRecords(context.Background(), "example.com", []miab.DNSRecord{
+		{QualifiedName: "a.example.com", RecordType: miab.A, Value: "192.0.2.1"},
+		{QualifiedName: "www.example.org", RecordType: miab.A, Value: "192.0.2.2"},
+	})
+	if !errors.Is(err, ErrNameOutsideZone) {
+		t.Fatalf("got %v, want ErrNameOutsideZone", err)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q", w)
+	}
+}
@@ -0,0 +1,141 @@
+package mailinabox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// zoneSnapshot is the JSON form of a zone produced by SnapshotZone.
+type zoneSnapshot struct {
+	Zone    string           `json:"zone"`
+	Records []snapshotRecord `json:"records"`
+}
+
+type snapshotRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// SnapshotZone returns the records of the zone as a portable JSON document
+// that RestoreZone can recreate them from.
+func (p *Provider) SnapshotZone(ctx context.Context, zone string) ([]byte, error) {
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	snap := zoneSnapshot{Zone: p.zoneOrDefault(zone), Records: []snapshotRecord{}}
+	for _, r := range records {
+		snap.Records = append(snap.Records, snapshotRecord{
+			Name:  r.Name,
+			Type:  r.Type,
+			Value: r.Value,
+			TTL:   int64(r.TTL / time.Second),
+		})
+	}
+	return json.MarshalIndent(snap, "", "\t")
+}
+
+// RestoreZone recreates the records of a snapshot taken by SnapshotZone in
+// the zone. With replace, records not in the snapshot are deleted and
+// single-valued records are overwritten; otherwise the snapshot's records
+// are only added where missing.
+func (p *Provider) RestoreZone(ctx context.Context, zone string, snapshot []byte, replace bool) error {
+	records, err := readSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	plan, err := p.Plan(ctx, zone, records)
+	if err != nil {
+		return err
+	}
+	if !replace {
+		plan.Adds = append(plan.Adds, plan.Updates...)
+		plan.Updates = nil
+		plan.Deletes = nil
+	}
+	return p.Apply(ctx, plan)
+}
+
+// GetRecordsModifiedSince returns the records in the zone that are not in
+// a snapshot taken earlier by SnapshotZone: records added since, and the
+// new values of records changed since. The Mail-In-A-Box API keeps no
+// modification times, so the snapshot stands in for a timestamp.
+func (p *Provider) GetRecordsModifiedSince(ctx context.Context, zone string, snapshot []byte) ([]libdns.Record, error) {
+	old, err := readSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[[3]string]bool, len(old))
+	for _, r := range old {
+		seen[[3]string{r.Name, r.Type, r.Value}] = true
+	}
+	modified := []libdns.Record{}
+	for _, r := range records {
+		if !seen[[3]string{r.Name, r.Type, r.Value}] {
+			modified = append(modified, r)
+		}
+	}
+	return modified, nil
+}
+
+// readSnapshot returns the records of a snapshot taken by SnapshotZone.
+func readSnapshot(snapshot []byte) ([]libdns.Record, error) {
+	var snap zoneSnapshot
+	if err := json.Unmarshal(snapshot, &snap); err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	records := make([]libdns.Record, len(snap.Records))
+	for i, r := range snap.Records {
+		records[i] = libdns.Record{
+			Type:  r.Type,
+			Name:  r.Name,
+			Value: r.Value,
+			TTL:   time.Duration(r.TTL) * time.Second,
+		}
+	}
+	return records, nil
+}
+
+// ExportZoneFile returns the zone file the box serves for zone, in the
+// standard text format. For a subdomain of a hosted zone, the whole hosted
+// zone is exported. Unlike SnapshotZone, it includes the records the box
+// manages itself.
+func (p *Provider) ExportZoneFile(ctx context.Context, zone string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.ExportZoneFileTo(ctx, zone, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExportZoneFileTo writes the zone file ExportZoneFile returns to w as it is
+// received, without holding it in memory.
+func (p *Provider) ExportZoneFileTo(ctx context.Context, zone string, w io.Writer) (err error) {
+	zone = p.zoneOrDefault(zone)
+	controlled, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return err
+	}
+	ctx, end := p.startSpan(ctx, "GET zonefile", controlled, miab.DNSRecord{})
+	defer func() { end(err) }()
+	resp, err := p.get(ctx, zone, "zonefile/"+controlled)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,119 @@
+package mailinabox
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	src := newMockBox(t, "example.com")
+	src.add(
+		"example.com MX 10 mail.example.com.",
+		"example.com TXT v=spf1 -all",
+		"www.example.com A 192.0.2.1",
+		"www.example.com A 192.0.2.2",
+		"alias.example.com CNAME www.example.com.",
+		"_sip._tcp.example.com SRV 10 5 5060 sip.example.com.",
+	)
+	snapshot, err := src.provider().SnapshotZone(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newMockBox(t, "example.com")
+	dst.add("stale.example.com A 192.0.2.9")
+	p := dst.provider()
+	if err := p.RestoreZone(context.Background(), "example.com.", snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	want := append(src.stored(), "stale.example.com A 192.0.2.9")
+	slices.Sort(want)
+	if got := dst.stored(); !slices.Equal(got, want) {
+		t.Fatalf("restored without replace: %q, want %q", got, want)
+	}
+
+	if err := p.RestoreZone(context.Background(), "example.com.", snapshot, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dst.stored(), src.stored(); !slices.Equal(got, want) {
+		t.Fatalf("restored with replace: %q, want %q", got, want)
+	}
+	again, err := p.SnapshotZone(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(snapshot) {
+		t.Fatalf("snapshot of the restored zone\n%s\ndiffers from the original\n%s", again, snapshot)
+	}
+}
+
+func TestGetRecordsModifiedSince(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add(
+		"www.example.com A 192.0.2.1",
+		"mail.example.com A 192.0.2.2",
+		"old.example.com TXT gone",
+	)
+	p := box.provider()
+	snapshot, err := p.SnapshotZone(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified, err := p.GetRecordsModifiedSince(context.Background(), "example.com", snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified == nil || len(modified) != 0 {
+		t.Fatalf("got %v right after the snapshot, want an empty list", modified)
+	}
+
+	if _, err := p.SetRecords(context.Background(), "example.com", []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{{Type: "TXT", Name: "new", Value: "hello"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.DeleteRecords(context.Background(), "example.com", []libdns.Record{{Type: "TXT", Name: "old", Value: "gone"}}); err != nil {
+		t.Fatal(err)
+	}
+	modified, err = p.GetRecordsModifiedSince(context.Background(), "example.com", snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range modified {
+		got = append(got, r.Name+" "+r.Type+" "+r.Value)
+	}
+	if want := []string{"new TXT hello", "www A 192.0.2.9"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := p.GetRecordsModifiedSince(context.Background(), "example.com", []byte("not json")); err == nil {
+		t.Fatal("accepted a snapshot that is not JSON")
+	}
+}
+
+func TestExportZoneFileTo(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.zoneFiles["example.com"] = "$ORIGIN example.com.\n$TTL 86400\nwww IN A 192.0.2.1\n" + strings.Repeat("; padding\n", 10000)
+	p := box.provider()
+	want, err := p.ExportZoneFile(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(want) != box.zoneFiles["example.com"] {
+		t.Fatalf("ExportZoneFile returned %d bytes, want the %d the box serves", len(want), len(box.zoneFiles["example.com"]))
+	}
+	var buf bytes.Buffer
+	if err := p.ExportZoneFileTo(context.Background(), "www.example.com", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("ExportZoneFileTo wrote %d bytes, want the %d ExportZoneFile returns", buf.Len(), len(want))
+	}
+}
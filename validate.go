@@ -0,0 +1,291 @@
+package mailinabox
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+// ErrUnsupportedRecordType is returned when writing a record of a type the
+// Mail-In-A-Box custom DNS API does not accept, such as OPENPGPKEY.
+var ErrUnsupportedRecordType = errors.New("unsupported record type")
+
+// RecordSizeError is returned when a record value is too large to be
+// written to the box as a single DNS record.
+type RecordSizeError struct {
+	Name   string
+	Type   string
+	Length int
+}
+
+func (e *RecordSizeError) Error() string {
+	return fmt.Sprintf("record %s (%s) is too large: %d bytes", e.Name, e.Type, e.Length)
+}
+
+// InvalidRecordError is returned when a field of a record value is
+// malformed for the record's type.
+type InvalidRecordError struct {
+	Name   string
+	Type   string
+	Field  string
+	Reason string
+}
+
+func (e *InvalidRecordError) Error() string {
+	return fmt.Sprintf("invalid %s record %s: %s %s", e.Type, e.Name, e.Field, e.Reason)
+}
+
+// BatchTooLargeError is returned when the records of a single write exceed
+// MaxBatchBytes.
+type BatchTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *BatchTooLargeError) Error() string {
+	return fmt.Sprintf("batch of %d bytes exceeds the limit of %d bytes", e.Size, e.Max)
+}
+
+// checkBatchSize refuses a batch whose names, types and values add up to
+// more than MaxBatchBytes.
+func (p *Provider) checkBatchSize(batches ...[]libdns.Record) error {
+	if p.MaxBatchBytes <= 0 {
+		return nil
+	}
+	size := 0
+	for _, records := range batches {
+		for _, r := range records {
+			size += len(r.Name) + len(r.Type) + len(r.Value)
+		}
+	}
+	if size > p.MaxBatchBytes {
+		return &BatchTooLargeError{Size: size, Max: p.MaxBatchBytes}
+	}
+	return nil
+}
+
+// ValidateRecords checks records the way a write would, without contacting
+// the box, and returns every problem found rather than stopping at the
+// first. It returns nil when all records can be written.
+func (p *Provider) ValidateRecords(zone string, records []libdns.Record) []error {
+	zone = p.zoneOrDefault(zone)
+	var errs []error
+	for _, r := range records {
+		if _, err := p.prepareRecord(zone, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkRecord verifies that the box will accept r before it is written.
+func checkRecord(name string, r libdns.Record) error {
+	if err := checkType(r); err != nil {
+		return err
+	}
+	if r.TTL < 0 {
+		return &InvalidRecordError{Name: name, Type: strings.ToUpper(r.Type), Field: "TTL", Reason: "is negative"}
+	}
+	if err := checkValue(name, r); err != nil {
+		return err
+	}
+	return checkSize(name, r)
+}
+
+func checkType(r libdns.Record) error {
+	rtype := miab.RecordType(r.Type)
+	if builtinType(rtype) {
+		return nil
+	}
+	if _, ok := lookupConverter(rtype); ok {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedRecordType, r.Type)
+}
+
+// checkValue validates the fields of the record value for its type.
+func checkValue(name string, r libdns.Record) error {
+	rtype := miab.RecordType(strings.ToUpper(r.Type))
+	invalid := func(field, reason string) error {
+		return &InvalidRecordError{Name: name, Type: string(rtype), Field: field, Reason: reason}
+	}
+	value := strings.TrimSpace(r.Value)
+	fields := strings.Fields(value)
+	switch rtype {
+	case miab.A:
+		if ip, err := netip.ParseAddr(value); err != nil || !ip.Is4() {
+			return invalid("address", fmt.Sprintf("%q is not an IPv4 address", value))
+		}
+	case miab.AAAA:
+		if ip, err := netip.ParseAddr(value); err != nil || !ip.Is6() {
+			return invalid("address", fmt.Sprintf("%q is not an IPv6 address", value))
+		}
+	case miab.CNAME, miab.NS:
+		if !isHostname(value) {
+			return invalid("target", fmt.Sprintf("%q is not a valid host name", value))
+		}
+	case miab.MX:
+		if len(fields) != 2 {
+			return invalid("value", "must be \"preference target\"")
+		}
+		if !isUint(fields[0], 16) {
+			return invalid("preference", fmt.Sprintf("%q is not a number from 0 to 65535", fields[0]))
+		}
+		if fields[1] != "." && !isHostname(fields[1]) {
+			return invalid("target", fmt.Sprintf("%q is not a valid host name", fields[1]))
+		}
+	case miab.SRV:
+		if len(fields) != 4 {
+			return invalid("value", "must be \"priority weight port target\"")
+		}
+		for i, field := range []string{"priority", "weight", "port"} {
+			if !isUint(fields[i], 16) {
+				return invalid(field, fmt.Sprintf("%q is not a number from 0 to 65535", fields[i]))
+			}
+		}
+		if fields[3] != "." && !isHostname(fields[3]) {
+			return invalid("target", fmt.Sprintf("%q is not a valid host name", fields[3]))
+		}
+	case miab.CAA:
+		if len(fields) < 3 {
+			return invalid("value", "must be \"flags tag value\"")
+		}
+		if !isUint(fields[0], 8) {
+			return invalid("flags", fmt.Sprintf("%q is not a number from 0 to 255", fields[0]))
+		}
+		if !caaTag.MatchString(fields[1]) {
+			return invalid("tag", fmt.Sprintf("%q is not a valid property tag", fields[1]))
+		}
+	case miab.SSHFP:
+		if len(fields) != 3 {
+			return invalid("value", "must be \"algorithm type fingerprint\"")
+		}
+		if !isUint(fields[0], 8) {
+			return invalid("algorithm", fmt.Sprintf("%q is not a number from 0 to 255", fields[0]))
+		}
+		if !isUint(fields[1], 8) {
+			return invalid("type", fmt.Sprintf("%q is not a number from 0 to 255", fields[1]))
+		}
+		if !hexString.MatchString(fields[2]) {
+			return invalid("fingerprint", fmt.Sprintf("%q is not hexadecimal", fields[2]))
+		}
+	case miab.TXT:
+		if value == "" {
+			return invalid("text", "is empty")
+		}
+	}
+	return nil
+}
+
+// checkStrict enforces the field requirements of StrictValidation.
+func checkStrict(name string, r libdns.Record) error {
+	rtype := miab.RecordType(strings.ToUpper(r.Type))
+	invalid := func(field, reason string) error {
+		return &InvalidRecordError{Name: name, Type: string(rtype), Field: field, Reason: reason}
+	}
+	if r.TTL != 0 {
+		return invalid("TTL", "is not supported by the box")
+	}
+	switch rtype {
+	case miab.MX, miab.SRV:
+		fields := strings.Fields(r.Value)
+		priority := "priority"
+		if rtype == miab.MX {
+			priority = "preference"
+		}
+		switch {
+		case len(fields) == 0 || isUint(fields[len(fields)-1], 16):
+			return invalid("target", "is missing")
+		case len(fields) == priorityFields[rtype]-1 && r.Priority == 0:
+			// formatValue would write a priority of 0.
+			return invalid(priority, "is missing from both the value and Priority")
+		case len(fields) == priorityFields[rtype] && r.Priority != 0 && fields[0] != strconv.Itoa(r.Priority):
+			// The value carries the priority; a Priority field that
+			// disagrees with it would be silently dropped.
+			return invalid("priority", fmt.Sprintf("%d does not match the value %q", r.Priority, r.Value))
+		}
+	default:
+		if r.Priority != 0 {
+			return invalid("priority", "is not used by this record type")
+		}
+	}
+	return nil
+}
+
+// checkName enforces the label rules of RFC 1035 on a qualified record
+// name for ValidateNames. Labels may start with an underscore, as those of
+// SRV and TXT records do, except on A and AAAA records, which name hosts.
+func checkName(name string, rtype miab.RecordType) error {
+	invalid := func(reason string) error {
+		return &InvalidRecordError{Name: name, Type: string(rtype), Field: "name", Reason: reason}
+	}
+	if len(name) > 253 {
+		return invalid(fmt.Sprintf("is %d characters long, more than 253", len(name)))
+	}
+	for i, label := range strings.Split(name, ".") {
+		switch {
+		case label == "":
+			return invalid("has an empty label")
+		case len(label) > 63:
+			return invalid(fmt.Sprintf("label %q is %d characters long, more than 63", label, len(label)))
+		case label == "*":
+			if i > 0 {
+				return invalid("has a wildcard that is not the first label")
+			}
+		case strings.HasPrefix(label, "_") && (rtype == miab.A || rtype == miab.AAAA):
+			return invalid(fmt.Sprintf("label %q starts with an underscore, which host names cannot", label))
+		case !nameLabel.MatchString(label):
+			return invalid(fmt.Sprintf("label %q may only contain letters, digits and inner hyphens", label))
+		}
+	}
+	return nil
+}
+
+var (
+	caaTag    = regexp.MustCompile(`^[A-Za-z0-9]{1,15}$`)
+	hexString = regexp.MustCompile(`^([0-9A-Fa-f]{2})+$`)
+	hostLabel = regexp.MustCompile(`^(\*|_?[A-Za-z0-9]([A-Za-z0-9_-]{0,61}[A-Za-z0-9])?)$`)
+	nameLabel = regexp.MustCompile(`^_?[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+)
+
+// isHostname reports whether s is a valid, optionally fully qualified,
+// host name.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if !hostLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func isUint(s string, bits int) bool {
+	_, err := strconv.ParseUint(s, 10, bits)
+	return err == nil
+}
+
+// maxRDataLength is the largest RDATA a single DNS record can carry.
+const maxRDataLength = 65535
+
+// checkSize ensures a TXT value still fits in one record once the box splits
+// it into 255-byte character-strings, each prefixed with a length byte.
+func checkSize(name string, r libdns.Record) error {
+	if !strings.EqualFold(r.Type, string(miab.TXT)) {
+		return nil
+	}
+	n := len(r.Value)
+	if n+(n+254)/255 > maxRDataLength {
+		return &RecordSizeError{Name: name, Type: r.Type, Length: n}
+	}
+	return nil
+}
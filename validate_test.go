@@ -0,0 +1,219 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	miab "github.com/luv2code/gomiabdns"
+)
+
+func TestRecordSizeError(t *testing.T) {
+	// The box splits TXT values into 255-byte strings, each costing a
+	// length byte, and a record holds at most 65535 bytes.
+	fits := libdns.Record{Type: "TXT", Name: "big", Value: strings.Repeat("a", 65279)}
+	if _, err := toMIABRecord("example.com", fits); err != nil {
+		t.Fatalf("value of %d bytes: %v", len(fits.Value), err)
+	}
+
+	tooBig := libdns.Record{Type: "TXT", Name: "big", Value: strings.Repeat("a", 65280)}
+	_, err := toMIABRecord("example.com", tooBig)
+	var sizeErr *RecordSizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("got %v, want a RecordSizeError", err)
+	}
+	if sizeErr.Length != 65280 || sizeErr.Name != "big.example.com" || sizeErr.Type != "TXT" {
+		t.Fatalf("got %+v, want the name, type and length of the value", sizeErr)
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		rtype, valid, invalid, field string
+	}{
+		{"A", "192.0.2.1", "192.0.2.256", "address"},
+		{"AAAA", "2001:db8::1", "192.0.2.1", "address"},
+		{"CNAME", "target.example.com.", "target..example.com", "target"},
+		{"NS", "ns1.example.net", "ns1 example net", "target"},
+		{"MX", "10 mail.example.com.", "100000 mail.example.com.", "preference"},
+		{"SRV", "10 5 5060 sip.example.com.", "10 5 sip sip.example.com.", "port"},
+		{"CAA", `0 issue "letsencrypt.org"`, `0 is-sue "letsencrypt.org"`, "tag"},
+		{"SSHFP", "1 2 0123456789abcdef", "1 2 not-hex", "fingerprint"},
+		{"TXT", "hello", "  ", "text"},
+	}
+	for _, tt := range tests {
+		if err := checkValue("www.example.com", libdns.Record{Type: tt.rtype, Value: tt.valid}); err != nil {
+			t.Errorf("%s %q: %v", tt.rtype, tt.valid, err)
+		}
+		err := checkValue("www.example.com", libdns.Record{Type: tt.rtype, Value: tt.invalid})
+		var invalid *InvalidRecordError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s %q: got %v, want an InvalidRecordError", tt.rtype, tt.invalid, err)
+			continue
+		}
+		if invalid.Field != tt.field || invalid.Type != tt.rtype || invalid.Name != "www.example.com" {
+			t.Errorf("%s %q: got %+v, want the %s field named", tt.rtype, tt.invalid, invalid, tt.field)
+		}
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		record libdns.Record
+		field  string
+	}{
+		{"MX missing a target", libdns.Record{Type: "MX", Name: "@", Value: "10"}, "target"},
+		{"MX missing a target with Priority", libdns.Record{Type: "MX", Name: "@", Value: "10", Priority: 10}, "target"},
+		{"MX missing a preference", libdns.Record{Type: "MX", Name: "@", Value: "mail.example.com"}, "preference"},
+		{"MX with a conflicting Priority", libdns.Record{Type: "MX", Name: "@", Value: "10 mail.example.com", Priority: 20}, "priority"},
+		{"SRV missing a priority", libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "5 5060 sip.example.com"}, "priority"},
+		{"SRV missing a target", libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060"}, "target"},
+		{"A with an invalid IP", libdns.Record{Type: "A", Name: "www", Value: "192.0.2.300"}, "address"},
+		{"A with a Priority", libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", Priority: 10}, "priority"},
+		{"TXT with a TTL", libdns.Record{Type: "TXT", Name: "www", Value: "hello", TTL: time.Hour}, "TTL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			box := newMockBox(t, "example.com")
+			p := box.provider()
+			p.StrictValidation = true
+			_, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{tt.record})
+			var invalid *InvalidRecordError
+			if !errors.As(err, &invalid) || invalid.Field != tt.field {
+				t.Fatalf("got %v, want an InvalidRecordError about the %s", err, tt.field)
+			}
+			if w := box.writes(); len(w) != 0 {
+				t.Fatalf("made writes %q", w)
+			}
+		})
+	}
+
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	p.StrictValidation = true
+	_, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{
+		{Type: "MX", Name: "@", Value: "10 mail.example.com"},
+		{Type: "MX", Name: "@", Value: "mail2.example.com", Priority: 20},
+		{Type: "MX", Name: "@", Value: "30 mail3.example.com", Priority: 30},
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"example.com MX 10 mail.example.com.",
+		"example.com MX 20 mail2.example.com.",
+		"example.com MX 30 mail3.example.com.",
+		"www.example.com A 192.0.2.1",
+	}
+	if got := box.stored(); !slices.Equal(got, want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	// Each record counts 3+1+9 = 13 bytes of name, type and value.
+	records := []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+	}
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	p.MaxBatchBytes = 25
+	_, err := p.SetRecords(context.Background(), "example.com", records)
+	var tooLarge *BatchTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 26 || tooLarge.Max != 25 {
+		t.Fatalf("got %v, want a BatchTooLargeError for 26 bytes", err)
+	}
+	if _, err := p.AppendRecords(context.Background(), "example.com", records); !errors.As(err, &tooLarge) {
+		t.Fatalf("AppendRecords: got %v, want a BatchTooLargeError", err)
+	}
+	if err := p.Apply(context.Background(), ChangePlan{Zone: "example.com", Adds: records[:1], Deletes: records[1:]}); !errors.As(err, &tooLarge) {
+		t.Fatalf("Apply: got %v, want a BatchTooLargeError", err)
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q", w)
+	}
+
+	p.MaxBatchBytes = 26
+	if _, err := p.SetRecords(context.Background(), "example.com", records); err != nil {
+		t.Fatalf("batch at the limit: %v", err)
+	}
+}
+
+func TestValidateRecords(t *testing.T) {
+	p := &Provider{}
+	errs := p.ValidateRecords("example.com", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		{Type: "A", Name: "bad", Value: "192.0.2.300"},
+		{Type: "TXT", Name: "ok", Value: "hello"},
+		{Type: "BOGUS", Name: "odd", Value: "x"},
+		{Type: "AAAA", Name: "v6", Value: "192.0.2.1"},
+	})
+	if len(errs) != 3 {
+		t.Fatalf("got %v, want three errors", errs)
+	}
+	var invalid *InvalidRecordError
+	if !errors.As(errs[0], &invalid) || invalid.Name != "bad.example.com" {
+		t.Errorf("first error %v, want one about bad.example.com", errs[0])
+	}
+	if !errors.Is(errs[1], ErrUnsupportedRecordType) {
+		t.Errorf("second error %v, want ErrUnsupportedRecordType", errs[1])
+	}
+	if !errors.As(errs[2], &invalid) || invalid.Name != "v6.example.com" {
+		t.Errorf("third error %v, want one about v6.example.com", errs[2])
+	}
+
+	if errs := p.ValidateRecords("example.com", []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1"}}); errs != nil {
+		t.Fatalf("got %v for a valid record, want nil", errs)
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	tests := []struct {
+		name  string
+		rtype miab.RecordType
+		valid bool
+	}{
+		{"www.example.com", miab.A, true},
+		{strings.Repeat("a", 63) + ".example.com", miab.A, true},
+		{"*.example.com", miab.A, true},
+		{"_sip._tcp.example.com", miab.SRV, true},
+		{long + ".example.com", miab.A, false},
+		{"www_1.example.com", miab.A, false},
+		{"bad!name.example.com", miab.TXT, false},
+		{"-www.example.com", miab.A, false},
+		{"_dmarc.example.com", miab.A, false},
+		{"www.*.example.com", miab.A, false},
+	}
+	for _, tt := range tests {
+		err := checkName(tt.name, tt.rtype)
+		if tt.valid && err != nil {
+			t.Errorf("%s %s: %v", tt.name, tt.rtype, err)
+		}
+		var invalid *InvalidRecordError
+		if !tt.valid && (!errors.As(err, &invalid) || invalid.Field != "name") {
+			t.Errorf("%s %s: got %v, want an InvalidRecordError about the name", tt.name, tt.rtype, err)
+		}
+	}
+
+	box := newMockBox(t, "example.com")
+	p := box.provider()
+	p.ValidateNames = true
+	for _, name := range []string{long, "bad!name"} {
+		_, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{{Type: "TXT", Name: name, Value: "hello"}})
+		var invalid *InvalidRecordError
+		if !errors.As(err, &invalid) || invalid.Field != "name" {
+			t.Errorf("%q: got %v, want an InvalidRecordError about the name", name, err)
+		}
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q", w)
+	}
+}
@@ -0,0 +1,184 @@
+package mailinabox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// controlledZones returns the zones that the box responsible for zone is
+// authoritative for.
+func (p *Provider) controlledZones(ctx context.Context, zone string) ([]string, error) {
+	var zones []string
+	if err := p.getJSON(ctx, zone, "zones", &zones); err != nil {
+		return nil, err
+	}
+	for i, z := range zones {
+		zones[i] = normalizeZone(z)
+	}
+	return zones, nil
+}
+
+// matchZone finds the controlled zone that zone belongs to. Unless
+// RequireExactZone is set, a subdomain of a controlled zone matches its
+// closest controlled parent.
+func (p *Provider) matchZone(zone string, controlled []string) (string, bool) {
+	match := ""
+	for _, cz := range controlled {
+		if zone == cz {
+			return cz, true
+		}
+		if !p.RequireExactZone && strings.HasSuffix(zone, "."+cz) && len(cz) > len(match) {
+			match = cz
+		}
+	}
+	return match, match != ""
+}
+
+// zoneCheck verifies that the box controls zone and returns the controlled
+// zone it was matched against.
+func (p *Provider) zoneCheck(ctx context.Context, zone string) (string, error) {
+	if zone == "" {
+		return "", errors.New("no zone given and DefaultZone is not set")
+	}
+	controlled, err := p.controlledZones(ctx, zone)
+	if err != nil {
+		return "", err
+	}
+	cz, ok := p.matchZone(zone, controlled)
+	if !ok {
+		return "", fmt.Errorf("This DNS provider (%s) does not control the specified zone (%s)", p.apiURL(zone), zone)
+	}
+	return cz, nil
+}
+
+// ListZones returns the zones hosted on the configured boxes as fully
+// qualified names with a trailing dot, ready to be passed to the other
+// methods.
+func (p *Provider) ListZones(ctx context.Context) ([]string, error) {
+	routes := []string{}
+	if p.APIURL != "" {
+		routes = append(routes, "")
+	}
+	for suffix := range p.Boxes {
+		routes = append(routes, normalizeZone(suffix))
+	}
+	seen := make(map[string]bool)
+	zones := []string{}
+	for _, route := range routes {
+		controlled, err := p.controlledZones(ctx, route)
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range controlled {
+			if !seen[z] {
+				seen[z] = true
+				zones = append(zones, z+".")
+			}
+		}
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// ResolveZone returns the zone hosted on the box that operations on zone
+// work against, as a fully qualified name, and whether zone matched it
+// exactly rather than as a subdomain.
+func (p *Provider) ResolveZone(ctx context.Context, zone string) (controlledZone string, exact bool, err error) {
+	zone = p.zoneOrDefault(zone)
+	cz, err := p.zoneCheck(ctx, zone)
+	if err != nil {
+		return "", false, err
+	}
+	return cz + ".", cz == zone, nil
+}
+
+// GetNameservers returns the nameservers of the zone as fully qualified
+// names with a trailing dot: the targets of the NS records at the zone's
+// name in the zone file the box serves, which include the box's own and
+// secondary nameservers as well as custom NS records. For a subdomain of a
+// hosted zone the list is empty unless the subdomain is delegated.
+func (p *Provider) GetNameservers(ctx context.Context, zone string) ([]string, error) {
+	zone = p.zoneOrDefault(zone)
+	zoneFile, err := p.ExportZoneFile(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	nameservers := zoneFileNS(zoneFile, zone)
+	sort.Strings(nameservers)
+	return nameservers, nil
+}
+
+// zoneFileNS returns the NS targets of owner, a canonical qualified name,
+// in a zone file in the standard text format.
+func zoneFileNS(zoneFile []byte, owner string) []string {
+	nameservers := []string{}
+	origin, name := "", ""
+	depth := 0
+	for _, line := range strings.Split(string(zoneFile), "\n") {
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		// Skip the continuation lines of records spanning several
+		// lines in parentheses, such as the SOA record.
+		inParens := depth > 0
+		depth += strings.Count(line, "(") - strings.Count(line, ")")
+		fields := strings.Fields(line)
+		if inParens || len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "$") {
+			if strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1 {
+				origin = canonicalName(fields[1])
+			}
+			continue
+		}
+		// A line starting with blank space continues the previous
+		// owner name.
+		if line[0] != ' ' && line[0] != '\t' {
+			name = zoneFileName(fields[0], origin)
+			fields = fields[1:]
+		}
+		for len(fields) > 0 && (isUint(fields[0], 32) || strings.EqualFold(fields[0], "IN")) {
+			fields = fields[1:]
+		}
+		if name == owner && len(fields) >= 2 && strings.EqualFold(fields[0], "NS") {
+			nameservers = append(nameservers, zoneFileName(fields[1], origin)+".")
+		}
+	}
+	return nameservers
+}
+
+// zoneFileName returns a name from a zone file in canonical form, relative
+// names being relative to origin.
+func zoneFileName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return canonicalName(name)
+	}
+	return canonicalName(name + "." + origin)
+}
+
+// GetSecondaryNameservers returns the secondary nameservers configured on
+// the box, as fully qualified names with a trailing dot. Hosts that are
+// only allowed zone transfers, given as "xfr:" entries on the box, are
+// not nameservers and are left out.
+func (p *Provider) GetSecondaryNameservers(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Hostnames []string `json:"hostnames"`
+	}
+	if err := p.getJSON(ctx, "", "secondary-nameserver", &resp); err != nil {
+		return nil, err
+	}
+	secondaries := []string{}
+	for _, h := range resp.Hostnames {
+		if h = strings.TrimSpace(h); h != "" && !strings.HasPrefix(h, "xfr:") {
+			secondaries = append(secondaries, normalizeTarget(h))
+		}
+	}
+	return secondaries, nil
+}
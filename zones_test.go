@@ -0,0 +1,159 @@
+package mailinabox
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func TestGetNameservers(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.zoneFiles["example.com"] = `$ORIGIN example.com.
+$TTL 86400
+@ IN SOA ns1.box.example.net. hostmaster.example.com. (
+	2024010101 ; serial
+	7200 ; refresh
+	3600 ; retry
+	1209600 ; expire
+	86400 ; minimum
+)
+example.com. IN NS ns1.box.example.net.
+	IN NS ns2.box.example.net.
+sub IN NS ns.elsewhere.example.
+www IN A 192.0.2.1
+`
+	p := box.provider()
+	got, err := p.GetNameservers(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ns1.box.example.net.", "ns2.box.example.net."}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	got, err = p.GetNameservers(context.Background(), "sub.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ns.elsewhere.example."}; !slices.Equal(got, want) {
+		t.Fatalf("subdomain got %q, want %q", got, want)
+	}
+}
+
+func TestGetSecondaryNameservers(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.secondaries = []string{"ns2.example.net", "xfr:192.0.2.53", " "}
+	got, err := box.provider().GetSecondaryNameservers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ns2.example.net."}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestGetAllRecords(t *testing.T) {
+	zones := []string{"a.example", "b.example", "c.example", "d.example", "e.example", "f.example"}
+	box := newMockBox(t, zones...)
+	for _, z := range zones {
+		box.add("www." + z + " A 192.0.2.1")
+	}
+	all, err := box.provider().GetAllRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(zones) {
+		t.Fatalf("got %d zones, want %d", len(all), len(zones))
+	}
+	for _, z := range zones {
+		if records := all[z+"."]; len(records) != 1 || records[0].Name != "www" {
+			t.Errorf("zone %s has %v, want its www record", z, records)
+		}
+	}
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	if box.maxInFlight > maxConcurrentZones {
+		t.Fatalf("%d requests in flight at once, want at most %d", box.maxInFlight, maxConcurrentZones)
+	}
+}
+
+func TestRequireExactZone(t *testing.T) {
+	box := newMockBox(t, "example.com")
+	box.add("www.sub.example.com A 192.0.2.1")
+	p := box.provider()
+
+	records, err := p.GetRecords(context.Background(), "sub.example.com")
+	if err != nil {
+		t.Fatalf("subdomain refused by default: %v", err)
+	}
+	if len(records) != 1 || records[0].Name != "www" {
+		t.Fatalf("got %v, want www relative to the subdomain", records)
+	}
+
+	p.RequireExactZone = true
+	if _, err := p.GetRecords(context.Background(), "sub.example.com"); err == nil {
+		t.Fatal("subdomain accepted with RequireExactZone")
+	}
+	if _, err := p.AppendRecords(context.Background(), "sub.example.com", []libdns.Record{
+		{Type: "A", Name: "new", Value: "192.0.2.2"},
+	}); err == nil {
+		t.Fatal("write to a subdomain accepted with RequireExactZone")
+	}
+	if w := box.writes(); len(w) != 0 {
+		t.Fatalf("made writes %q", w)
+	}
+	if _, err := p.GetRecords(context.Background(), "example.com"); err != nil {
+		t.Fatalf("exact zone refused with RequireExactZone: %v", err)
+	}
+}
+
+func TestZoneCaseAndDot(t *testing.T) {
+	for _, hosted := range []string{"example.com", "Example.COM", "example.com."} {
+		box := newMockBox(t, hosted)
+		p := box.provider()
+		for _, zone := range []string{"example.com", "example.com.", "Example.COM.", "EXAMPLE.com"} {
+			resolved, exact, err := p.ResolveZone(context.Background(), zone)
+			if err != nil {
+				t.Fatalf("box hosting %q, zone %q: %v", hosted, zone, err)
+			}
+			if resolved != "example.com." || !exact {
+				t.Errorf("box hosting %q, zone %q: resolved to %q (exact %t), want example.com. exactly", hosted, zone, resolved, exact)
+			}
+			if _, err := p.GetRecords(context.Background(), zone); err != nil {
+				t.Errorf("box hosting %q, zone %q: %v", hosted, zone, err)
+			}
+		}
+	}
+}
+
+func TestResolveZone(t *testing.T) {
+	box := newMockBox(t, "example.com", "sub.example.com")
+	p := box.provider()
+	tests := []struct {
+		zone, want string
+		exact      bool
+	}{
+		{"example.com.", "example.com.", true},
+		{"sub.example.com.", "sub.example.com.", true},
+		{"www.example.com.", "example.com.", false},
+		{"deep.www.sub.example.com", "sub.example.com.", false},
+	}
+	for _, tt := range tests {
+		got, exact, err := p.ResolveZone(context.Background(), tt.zone)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.zone, err)
+		}
+		if got != tt.want || exact != tt.exact {
+			t.Errorf("ResolveZone(%q) = %q, %t; want %q, %t", tt.zone, got, exact, tt.want, tt.exact)
+		}
+	}
+	if _, _, err := p.ResolveZone(context.Background(), "example.org."); err == nil {
+		t.Error("zone not on the box resolved")
+	}
+	p.RequireExactZone = true
+	if _, _, err := p.ResolveZone(context.Background(), "www.example.com."); err == nil {
+		t.Error("subdomain resolved with RequireExactZone")
+	}
+}